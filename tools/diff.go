@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Cross-environment diff
+
+Compares two RBAC states by name rather than ID, so preview and prod can be compared even though
+every object has a different ID in each. A source is one of:
+
+	config:<file>     a reconciler config file, e.g. config:config.json
+	snapshot:<file>   a snapshot written by the snapshot command
+	<url>             a live API, e.g. https://api.hellman.oxygen.dfds.cloud/ssu-preview/api
+
+Live sources read their token from an environment variable, SELF_SERVICE_API_TOKEN unless another
+one is named with --token-a/--token-b.
+
+A config file only defines Global role permissions, while live roles also hold the capability-scoped
+ones the API grants per capability. When either source is a config file, role permissions are compared
+Global only on both sides, the same way the sync diffs them.
+*/
+
+func loadStateSource(source, tokenEnvVar string) (*RbacState, error) {
+	kind, path, _ := strings.Cut(source, ":")
+	switch kind {
+	case "config":
+		config, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		state := desiredStateFromConfig(config)
+		state.Source = source
+		return state, nil
+	case "snapshot":
+		state, err := loadSnapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		state.Source = source
+		return state, nil
+	case "http", "https":
+		token := os.Getenv(tokenEnvVar)
+		if token == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", tokenEnvVar)
+		}
+		return fetchState(&Config{ApiUrl: strings.TrimSuffix(source, "/"), AccessToken: token}, false)
+	}
+	return nil, fmt.Errorf("unknown source '%s', expected config:<file>, snapshot:<file> or an API URL", source)
+}
+
+type stateDiff struct {
+	lines []string
+}
+
+func (d *stateDiff) add(format string, args ...interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf(format, args...))
+}
+
+func describeGrant(p PermissionGrant) string {
+	if strings.EqualFold(p.Type, "Global") || p.Type == "" {
+		return fmt.Sprintf("%s/%s", p.Namespace, p.Permission)
+	}
+	return fmt.Sprintf("%s/%s (%s %s)", p.Namespace, p.Permission, p.Type, p.Resource)
+}
+
+func describeBinding(g StateRoleGrant) string {
+	if strings.EqualFold(g.Type, "Global") {
+		return fmt.Sprintf("%s (Global)", g.RoleName)
+	}
+	return fmt.Sprintf("%s (%s %s)", g.RoleName, g.Type, g.Resource)
+}
+
+func sortedStrings(values []string) []string {
+	sort.Strings(values)
+	return values
+}
+
+// diffGrantLines lists grants only on one side, with "<" for a and ">" for b.
+func diffGrantLines(a, b []PermissionGrant) []string {
+	onlyInB, onlyInA := diffPermissions(b, a)
+	var lines []string
+	for _, p := range onlyInA {
+		lines = append(lines, "< "+describeGrant(p))
+	}
+	for _, p := range onlyInB {
+		lines = append(lines, "> "+describeGrant(p))
+	}
+	return sortedStrings(lines)
+}
+
+func diffStates(a, b *RbacState, includeMembers, globalRolePermissionsOnly bool) []string {
+	diff := &stateDiff{}
+
+	/*
+		Roles
+	*/
+	rolesA := map[string]StateRole{}
+	rolesB := map[string]StateRole{}
+	var roleNames []string
+	for _, role := range a.Roles {
+		rolesA[roleKey(role.Name)] = role
+		roleNames = append(roleNames, roleKey(role.Name))
+	}
+	for _, role := range b.Roles {
+		if _, inA := rolesA[roleKey(role.Name)]; !inA {
+			roleNames = append(roleNames, roleKey(role.Name))
+		}
+		rolesB[roleKey(role.Name)] = role
+	}
+	sort.Strings(roleNames)
+
+	for _, key := range roleNames {
+		roleA, inA := rolesA[key]
+		roleB, inB := rolesB[key]
+		switch {
+		case !inB:
+			diff.add("role '%s': only in a (%d permissions)", roleA.Name, len(roleA.Permissions))
+		case !inA:
+			diff.add("role '%s': only in b (%d permissions)", roleB.Name, len(roleB.Permissions))
+		default:
+			if !strings.EqualFold(roleA.Type, roleB.Type) {
+				diff.add("role '%s': type %s in a, %s in b", roleA.Name, roleA.Type, roleB.Type)
+			}
+			permissionsA, permissionsB := roleA.Permissions, roleB.Permissions
+			if globalRolePermissionsOnly {
+				permissionsA, permissionsB = filterGlobalPermissions(permissionsA), filterGlobalPermissions(permissionsB)
+			}
+			for _, line := range diffGrantLines(permissionsA, permissionsB) {
+				diff.add("role '%s': %s", roleA.Name, line)
+			}
+		}
+	}
+
+	/*
+		Groups
+	*/
+	groupsA := map[string]StateGroup{}
+	groupsB := map[string]StateGroup{}
+	var groupNames []string
+	for _, group := range a.Groups {
+		groupsA[group.Name] = group
+		groupNames = append(groupNames, group.Name)
+	}
+	for _, group := range b.Groups {
+		if _, inA := groupsA[group.Name]; !inA {
+			groupNames = append(groupNames, group.Name)
+		}
+		groupsB[group.Name] = group
+	}
+	sort.Strings(groupNames)
+
+	for _, name := range groupNames {
+		groupA, inA := groupsA[name]
+		groupB, inB := groupsB[name]
+		switch {
+		case !inB:
+			diff.add("group '%s': only in a (%d role bindings, %d members)", name, len(groupA.RoleGrants), len(groupA.Members))
+			continue
+		case !inA:
+			diff.add("group '%s': only in b (%d role bindings, %d members)", name, len(groupB.RoleGrants), len(groupB.Members))
+			continue
+		}
+
+		bindingsA := map[string]StateRoleGrant{}
+		for _, grant := range groupA.RoleGrants {
+			bindingsA[roleGrantKey(grant)] = grant
+		}
+		bindingsB := map[string]StateRoleGrant{}
+		for _, grant := range groupB.RoleGrants {
+			bindingsB[roleGrantKey(grant)] = grant
+		}
+		var bindingLines []string
+		for key, grant := range bindingsA {
+			if _, inB := bindingsB[key]; !inB {
+				bindingLines = append(bindingLines, "< binds "+describeBinding(grant))
+			}
+		}
+		for key, grant := range bindingsB {
+			if _, inA := bindingsA[key]; !inA {
+				bindingLines = append(bindingLines, "> binds "+describeBinding(grant))
+			}
+		}
+		for _, line := range sortedStrings(bindingLines) {
+			diff.add("group '%s': %s", name, line)
+		}
+
+		for _, line := range diffGrantLines(groupA.Permissions, groupB.Permissions) {
+			diff.add("group '%s': %s", name, line)
+		}
+
+		if includeMembers {
+			membersA := map[string]bool{}
+			for _, member := range groupA.Members {
+				membersA[memberKey(member)] = true
+			}
+			membersB := map[string]bool{}
+			for _, member := range groupB.Members {
+				membersB[memberKey(member)] = true
+			}
+			var memberLines []string
+			for member := range membersA {
+				if !membersB[member] {
+					memberLines = append(memberLines, "< member "+member)
+				}
+			}
+			for member := range membersB {
+				if !membersA[member] {
+					memberLines = append(memberLines, "> member "+member)
+				}
+			}
+			for _, line := range sortedStrings(memberLines) {
+				diff.add("group '%s': %s", name, line)
+			}
+		}
+	}
+
+	return diff.lines
+}
+
+/*
+Command
+*/
+
+func runDiff(args []string) bool {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	members := flags.Bool("members", false, "include group members")
+	tokenA := flags.String("token-a", "SELF_SERVICE_API_TOKEN", "environment variable holding the token for a live source a")
+	tokenB := flags.String("token-b", "SELF_SERVICE_API_TOKEN", "environment variable holding the token for a live source b")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fatalf("usage: diff [--members] [--token-a <env var>] [--token-b <env var>] <source a> <source b>")
+	}
+
+	a, err := loadStateSource(flags.Arg(0), *tokenA)
+	if err != nil {
+		fatalf("failed to load '%s': %v", flags.Arg(0), err)
+	}
+	b, err := loadStateSource(flags.Arg(1), *tokenB)
+	if err != nil {
+		fatalf("failed to load '%s': %v", flags.Arg(1), err)
+	}
+
+	configSource := strings.HasPrefix(flags.Arg(0), "config:") || strings.HasPrefix(flags.Arg(1), "config:")
+	lines := diffStates(a, b, *members, configSource)
+	writeDiff(os.Stdout, a, b, lines)
+
+	return len(lines) == 0
+}
+
+func writeDiff(w io.Writer, a, b *RbacState, lines []string) {
+	fmt.Fprintf(w, "a: %s\nb: %s\n", a.Source, b.Source)
+	if len(lines) == 0 {
+		fmt.Fprintln(w, "No differences.")
+		return
+	}
+	fmt.Fprintln(w)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "\n%d difference(s).\n", len(lines))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffStates(t *testing.T) {
+	capabilityPermission := PermissionGrant{Namespace: "topics", Permission: "create", Type: "Capability", Resource: "cap-a"}
+
+	tests := []struct {
+		name                      string
+		a, b                      *RbacState
+		includeMembers            bool
+		globalRolePermissionsOnly bool
+		want                      []string
+	}{
+		{
+			name: "objects are compared by name, roles without case",
+			a: &RbacState{
+				Roles:  []StateRole{{ID: "r1", Name: "Reader", Type: "Global", Permissions: []PermissionGrant{globalPermission("topics", "read")}}},
+				Groups: []StateGroup{{ID: "g1", Name: "Readers", RoleGrants: []StateRoleGrant{globalBinding("Reader")}}},
+			},
+			b: &RbacState{
+				Roles:  []StateRole{{ID: "r2", Name: "reader", Type: "global", Permissions: []PermissionGrant{globalPermission("topics", "read")}}},
+				Groups: []StateGroup{{ID: "g2", Name: "Readers", RoleGrants: []StateRoleGrant{globalBinding("READER")}}},
+			},
+		},
+		{
+			name: "objects on one side only are listed with their size",
+			a:    &RbacState{Roles: []StateRole{{Name: "Old", Permissions: []PermissionGrant{globalPermission("topics", "read")}}}},
+			b:    &RbacState{Groups: []StateGroup{{Name: "New", Members: []string{"a@dfds.com"}}}},
+			want: []string{
+				"role 'Old': only in a (1 permissions)",
+				"group 'New': only in b (0 role bindings, 1 members)",
+			},
+		},
+		{
+			name: "role types and permissions are compared",
+			a:    &RbacState{Roles: []StateRole{{Name: "Owner", Type: "Global", Permissions: []PermissionGrant{globalPermission("topics", "read")}}}},
+			b:    &RbacState{Roles: []StateRole{{Name: "Owner", Type: "Capability", Permissions: []PermissionGrant{globalPermission("topics", "create"), capabilityPermission}}}},
+			want: []string{
+				"role 'Owner': type Global in a, Capability in b",
+				"role 'Owner': < topics/read",
+				"role 'Owner': > topics/create",
+				"role 'Owner': > topics/create (Capability cap-a)",
+			},
+		},
+		{
+			name:                      "capability role permissions are left out against a config",
+			a:                         &RbacState{Roles: []StateRole{{Name: "Owner", Type: "Global"}}},
+			b:                         &RbacState{Roles: []StateRole{{Name: "Owner", Type: "Global", Permissions: []PermissionGrant{capabilityPermission}}}},
+			globalRolePermissionsOnly: true,
+		},
+		{
+			name: "group bindings and permissions are compared",
+			a: &RbacState{Groups: []StateGroup{{Name: "Team", RoleGrants: []StateRoleGrant{
+				globalBinding("Reader"),
+				{RoleAssignment: RoleAssignment{Type: "Capability", Resource: "cap-a"}, RoleName: "Owner"},
+			}}}},
+			b: &RbacState{Groups: []StateGroup{{
+				Name:        "Team",
+				RoleGrants:  []StateRoleGrant{globalBinding("Contributor"), {RoleAssignment: RoleAssignment{Type: "Capability", Resource: "cap-a"}, RoleName: "owner"}},
+				Permissions: []PermissionGrant{capabilityPermission},
+			}}},
+			want: []string{
+				"group 'Team': < binds Reader (Global)",
+				"group 'Team': > binds Contributor (Global)",
+				"group 'Team': > topics/create (Capability cap-a)",
+			},
+		},
+		{
+			name: "members are left out unless asked for",
+			a:    &RbacState{Groups: []StateGroup{{Name: "Team", Members: []string{"a@dfds.com"}}}},
+			b:    &RbacState{Groups: []StateGroup{{Name: "Team", Members: []string{"b@dfds.com"}}}},
+		},
+		{
+			name:           "members are compared without case",
+			a:              &RbacState{Groups: []StateGroup{{Name: "Team", Members: []string{"A@dfds.com", "b@dfds.com"}}}},
+			b:              &RbacState{Groups: []StateGroup{{Name: "Team", Members: []string{"a@dfds.com", "c@dfds.com"}}}},
+			includeMembers: true,
+			want: []string{
+				"group 'Team': < member b@dfds.com",
+				"group 'Team': > member c@dfds.com",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diffStates(test.a, test.b, test.includeMembers, test.globalRolePermissionsOnly)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("diff:\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+Duplicate roles and groups
+
+fetchRoles and the diff engine key roles by lowercase name and groups by exact name, so two objects
+whose names differ only in case or whitespace silently collapse into one. This finds them, reports the
+grants hanging off each ID, and optionally merges a duplicate into the canonical ID from config.json.
+*/
+
+type duplicateSet struct {
+	Kind      string // "role" or "group"
+	Canonical string // ID pinned by 'existingId' in config.json, if any
+	Roles     []StateRole
+	Groups    []StateGroup
+}
+
+// duplicateKey folds case and removes all whitespace, so "Cloud Engineers " and "cloudengineers" collide.
+func duplicateKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+func findDuplicates(config *Config, state *RbacState) []duplicateSet {
+	pinnedRoles := make(map[string]string)
+	for _, role := range config.Roles {
+		if role.ExistingId != "" {
+			pinnedRoles[duplicateKey(role.Name)] = role.ExistingId
+		}
+	}
+	pinnedGroups := make(map[string]string)
+	for _, group := range resolveManagedGroups(config) {
+		if group.ExistingId != "" {
+			pinnedGroups[duplicateKey(group.Name)] = group.ExistingId
+		}
+	}
+
+	var sets []duplicateSet
+
+	rolesByKey := make(map[string][]StateRole)
+	var roleKeys []string
+	for _, role := range state.Roles {
+		key := duplicateKey(role.Name)
+		if _, seen := rolesByKey[key]; !seen {
+			roleKeys = append(roleKeys, key)
+		}
+		rolesByKey[key] = append(rolesByKey[key], role)
+	}
+	for _, key := range roleKeys {
+		if len(rolesByKey[key]) > 1 {
+			sets = append(sets, duplicateSet{Kind: "role", Canonical: pinnedRoles[key], Roles: rolesByKey[key]})
+		}
+	}
+
+	groupsByKey := make(map[string][]StateGroup)
+	var groupKeys []string
+	for _, group := range state.Groups {
+		key := duplicateKey(group.Name)
+		if _, seen := groupsByKey[key]; !seen {
+			groupKeys = append(groupKeys, key)
+		}
+		groupsByKey[key] = append(groupsByKey[key], group)
+	}
+	for _, key := range groupKeys {
+		if len(groupsByKey[key]) > 1 {
+			sets = append(sets, duplicateSet{Kind: "group", Canonical: pinnedGroups[key], Groups: groupsByKey[key]})
+		}
+	}
+
+	return sets
+}
+
+// fetchRoleUsage returns every role grant keyed by lowercase role ID: group grants from the state and,
+// because capability roles are granted to users directly, the grants of every member.
+func fetchRoleUsage(config *Config, state *RbacState) (map[string][]RoleAssignment, error) {
+	usage := make(map[string][]RoleAssignment)
+	for _, group := range state.Groups {
+		for _, grant := range group.RoleGrants {
+			usage[strings.ToLower(grant.RoleId)] = append(usage[strings.ToLower(grant.RoleId)], grant.RoleAssignment)
+		}
+	}
+
+	members, err := fetchAllMembers(config)
+	if err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+	for _, member := range members {
+		grants, err := fetchRoleGrantsForUser(config, member.Id)
+		if err != nil {
+			return nil, fmt.Errorf("role grants for member '%s': %w", member.Id, err)
+		}
+		for _, grant := range grants {
+			usage[strings.ToLower(grant.RoleId)] = append(usage[strings.ToLower(grant.RoleId)], grant)
+		}
+	}
+
+	return usage, nil
+}
+
+func printDuplicates(sets []duplicateSet, usage map[string][]RoleAssignment) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, set := range sets {
+		if set.Kind == "role" {
+			fmt.Fprintln(w, "ROLE\tID\tPERMISSION GRANTS\tROLE GRANTS\tCANONICAL")
+			for _, role := range set.Roles {
+				fmt.Fprintf(w, "%q\t%s\t%d\t%d\t%s\n", role.Name, role.ID, len(role.Permissions), len(usage[strings.ToLower(role.ID)]), canonicalMarker(set, role.ID))
+			}
+		} else {
+			fmt.Fprintln(w, "GROUP\tID\tMEMBERS\tROLE GRANTS\tPERMISSION GRANTS\tCANONICAL")
+			for _, group := range set.Groups {
+				fmt.Fprintf(w, "%q\t%s\t%d\t%d\t%d\t%s\n", group.Name, group.ID, len(group.Members), len(group.RoleGrants), len(group.Permissions), canonicalMarker(set, group.ID))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+func canonicalMarker(set duplicateSet, id string) string {
+	if set.Canonical == "" {
+		return "-"
+	}
+	if strings.EqualFold(set.Canonical, id) {
+		return "yes (existingId)"
+	}
+	return "no"
+}
+
+func runDuplicates(config *Config, merge bool) {
+	state, err := fetchState(config, false)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+
+	sets := findDuplicates(config, state)
+	if len(sets) == 0 {
+		log.Println("No duplicate roles or groups found.")
+		return
+	}
+
+	var usage map[string][]RoleAssignment
+	for _, set := range sets {
+		if set.Kind == "role" {
+			if usage, err = fetchRoleUsage(config, state); err != nil {
+				fatalf("failed to count role grants: %v", err)
+			}
+			break
+		}
+	}
+
+	log.Printf("Found %d set(s) of duplicate roles or groups:", len(sets))
+	printDuplicates(sets, usage)
+
+	if !merge {
+		log.Println("Run 'duplicates --merge' to move grants onto the canonical IDs and delete the duplicates.")
+		return
+	}
+
+	type plannedMerge struct {
+		set, canonical, duplicate int
+	}
+	var merges []plannedMerge
+
+	in := bufio.NewReader(os.Stdin)
+	for setIndex, set := range sets {
+		ids := make([]string, 0)
+		names := make([]string, 0)
+		for _, role := range set.Roles {
+			ids, names = append(ids, role.ID), append(names, role.Name)
+		}
+		for _, group := range set.Groups {
+			ids, names = append(ids, group.ID), append(names, group.Name)
+		}
+
+		canonical := -1
+		for i, id := range ids {
+			if strings.EqualFold(id, set.Canonical) {
+				canonical = i
+			}
+		}
+		if canonical < 0 {
+			fmt.Printf("No existingId in config.json for %s '%s'. Which one is canonical?\n", set.Kind, names[0])
+			for i, id := range ids {
+				fmt.Printf("  [%d] %q (%s)\n", i+1, names[i], id)
+			}
+			canonical = promptChoice(in, len(ids))
+			if canonical < 0 {
+				log.Printf("Skipping %s '%s'.", set.Kind, names[0])
+				continue
+			}
+		}
+
+		for i := range ids {
+			if i == canonical {
+				continue
+			}
+			question := fmt.Sprintf("Merge %s %q (%s) into %q (%s) and delete it?", set.Kind, names[i], ids[i], names[canonical], ids[canonical])
+			if !promptConfirm(in, question) {
+				log.Printf("Skipping %s %q (%s).", set.Kind, names[i], ids[i])
+				continue
+			}
+			merges = append(merges, plannedMerge{setIndex, canonical, i})
+		}
+	}
+
+	groupNames := make(map[string]string, len(state.Groups))
+	for _, group := range state.Groups {
+		groupNames[strings.ToLower(group.ID)] = group.Name
+	}
+	mergeAll := func(m merger, sets []duplicateSet, usage map[string][]RoleAssignment) {
+		for _, merge := range merges {
+			set := sets[merge.set]
+			if set.Kind == "role" {
+				m.mergeRole(&set.Roles[merge.canonical], set.Roles[merge.duplicate], usage)
+			} else {
+				m.mergeGroup(&set.Groups[merge.canonical], set.Groups[merge.duplicate])
+			}
+		}
+	}
+
+	// The merges are first planned on copies, so the safeguards are checked on all of them before the first write.
+	plannedSets := make([]duplicateSet, len(sets))
+	for i, set := range sets {
+		set.Roles = append([]StateRole(nil), set.Roles...)
+		set.Groups = append([]StateGroup(nil), set.Groups...)
+		plannedSets[i] = set
+	}
+	plannedUsage := make(map[string][]RoleAssignment, len(usage))
+	for id, grants := range usage {
+		plannedUsage[id] = grants
+	}
+	plan := &Plan{}
+	mergeAll(merger{config: config, groupNames: groupNames, plan: plan}, plannedSets, plannedUsage)
+	enforceSafeguards(config, plan)
+
+	mergeAll(merger{config: config, groupNames: groupNames}, sets, usage)
+}
+
+// merger makes the API calls of a merge. With plan set it only records them as changes, for the safeguards.
+type merger struct {
+	config     *Config
+	groupNames map[string]string // lowercase group ID -> name
+	plan       *Plan
+}
+
+func (m merger) do(change Change, call func() error) {
+	if m.plan != nil {
+		m.plan.add(change)
+		return
+	}
+	if err := call(); err != nil {
+		fatalf("failed to %s: %v", change, err)
+	}
+}
+
+// holder names who a role grant is for, in the fields a Change uses.
+func (m merger) holder(change Change, grant RoleAssignment) Change {
+	if strings.EqualFold(grant.AssignedEntityType, "Group") {
+		change.GroupName = m.groupNames[strings.ToLower(grant.AssignedEntityId)]
+	} else {
+		change.User = grant.AssignedEntityId
+	}
+	return change
+}
+
+// mergeRole moves the permissions and every grant of a duplicate role onto the canonical role, then deletes it.
+// canonical and usage are updated with what was moved, so the next duplicate of the set is merged against
+// the canonical role as it is now.
+func (m merger) mergeRole(canonical *StateRole, duplicate StateRole, usage map[string][]RoleAssignment) {
+	missing, _ := diffPermissions(duplicate.Permissions, canonical.Permissions)
+	for _, p := range missing {
+		grant := PermissionGrantCreation{
+			Namespace:          p.Namespace,
+			Permission:         p.Permission,
+			Type:               p.Type,
+			Resource:           p.Resource,
+			AssignedEntityType: "Role",
+			AssignedEntityId:   canonical.ID,
+		}
+		m.do(Change{Action: "grant-permission", RoleName: canonical.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource},
+			func() error { return grantScopedPermission(m.config, grant) })
+		canonical.Permissions = append(canonical.Permissions, p)
+	}
+	for _, p := range duplicate.Permissions {
+		p := p
+		m.do(Change{Action: "revoke-permission", RoleName: duplicate.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID},
+			func() error { return revokePermission(m.config, p) })
+	}
+
+	held := make(map[string]bool)
+	for _, grant := range usage[strings.ToLower(canonical.ID)] {
+		held[assigneeKey(grant)] = true
+	}
+	for _, grant := range usage[strings.ToLower(duplicate.ID)] {
+		grant := grant
+		if !held[assigneeKey(grant)] {
+			m.do(m.holder(Change{Action: "grant-role", RoleName: canonical.Name, Type: grant.Type, Resource: grant.Resource}, grant),
+				func() error {
+					return assignRole(m.config, canonical.ID, grant.AssignedEntityType, grant.AssignedEntityId, grant.Type, grant.Resource)
+				})
+			held[assigneeKey(grant)] = true
+			moved := grant
+			moved.ID, moved.RoleId = "", canonical.ID
+			usage[strings.ToLower(canonical.ID)] = append(usage[strings.ToLower(canonical.ID)], moved)
+		}
+		m.do(m.holder(Change{Action: "revoke-role", RoleName: duplicate.Name, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID}, grant),
+			func() error { return revokeRole(m.config, grant) })
+	}
+	delete(usage, strings.ToLower(duplicate.ID))
+
+	m.do(Change{Action: "delete-role", RoleName: duplicate.Name, ObjectId: duplicate.ID},
+		func() error { return deleteRole(m.config, duplicate.ID) })
+	if m.plan == nil {
+		log.Printf("- Merged role %q (%s) into %q (%s).", duplicate.Name, duplicate.ID, canonical.Name, canonical.ID)
+	}
+}
+
+// mergeGroup moves the members, role grants and permissions of a duplicate group onto the canonical group, then deletes it.
+// canonical is updated with what was moved, like in mergeRole.
+func (m merger) mergeGroup(canonical *StateGroup, duplicate StateGroup) {
+	members := make(map[string]bool)
+	for _, member := range canonical.Members {
+		members[memberKey(member)] = true
+	}
+	for _, member := range duplicate.Members {
+		member := member
+		if members[memberKey(member)] {
+			continue
+		}
+		m.do(Change{Action: "add-member", GroupName: canonical.Name, Member: member},
+			func() error { return createMembership(m.config, canonical.ID, member) })
+		members[memberKey(member)] = true
+		canonical.Members = append(canonical.Members, member)
+	}
+
+	held := make(map[string]bool)
+	for _, grant := range canonical.RoleGrants {
+		held[roleGrantKey(grant)] = true
+	}
+	for _, grant := range duplicate.RoleGrants {
+		grant := grant
+		if !held[roleGrantKey(grant)] {
+			m.do(Change{Action: "grant-role", GroupName: canonical.Name, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource},
+				func() error {
+					return assignRole(m.config, grant.RoleId, "Group", canonical.ID, grant.Type, grant.Resource)
+				})
+			held[roleGrantKey(grant)] = true
+			moved := grant
+			moved.ID, moved.AssignedEntityId = "", canonical.ID
+			canonical.RoleGrants = append(canonical.RoleGrants, moved)
+		}
+		m.do(Change{Action: "revoke-role", GroupName: duplicate.Name, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID},
+			func() error { return revokeRole(m.config, grant.RoleAssignment) })
+	}
+
+	missing, _ := diffPermissions(duplicate.Permissions, canonical.Permissions)
+	for _, p := range missing {
+		grant := PermissionGrantCreation{
+			Namespace:          p.Namespace,
+			Permission:         p.Permission,
+			Type:               p.Type,
+			Resource:           p.Resource,
+			AssignedEntityType: "Group",
+			AssignedEntityId:   canonical.ID,
+		}
+		m.do(Change{Action: "grant-permission", GroupName: canonical.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource},
+			func() error { return grantScopedPermission(m.config, grant) })
+		canonical.Permissions = append(canonical.Permissions, p)
+	}
+	for _, p := range duplicate.Permissions {
+		p := p
+		m.do(Change{Action: "revoke-permission", GroupName: duplicate.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID},
+			func() error { return revokePermission(m.config, p) })
+	}
+
+	m.do(Change{Action: "delete-group", GroupName: duplicate.Name, ObjectId: duplicate.ID},
+		func() error { return deleteGroup(m.config, duplicate.ID) })
+	if m.plan == nil {
+		log.Printf("- Merged group %q (%s) into %q (%s).", duplicate.Name, duplicate.ID, canonical.Name, canonical.ID)
+	}
+}
+
+// assigneeKey identifies who a role grant is for and where, independent of the role.
+func assigneeKey(grant RoleAssignment) string {
+	return fmt.Sprintf(
+		"%s|%s|%s|%s",
+		strings.ToLower(grant.AssignedEntityType),
+		strings.ToLower(grant.AssignedEntityId),
+		strings.ToLower(strings.TrimSpace(grant.Type)),
+		normalizeGrantResource(grant.Type, grant.Resource),
+	)
+}
+
+/*
+Prompts
+*/
+
+func promptConfirm(in *bufio.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// promptChoice reads a 1-based choice and returns it 0-based, or -1 to skip.
+func promptChoice(in *bufio.Reader, count int) int {
+	for {
+		fmt.Printf("Choose 1-%d, or s to skip: ", count)
+		answer, err := in.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		if strings.EqualFold(answer, "s") || (err != nil && answer == "") {
+			return -1
+		}
+		if n, convErr := strconv.Atoi(answer); convErr == nil && n >= 1 && n <= count {
+			return n - 1
+		}
+	}
+}
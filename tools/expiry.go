@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Time-bound access
+
+Members and role bindings in config.json can carry an expiry date, for contractors and temporary elevated
+access:
+
+	"members": ["someone@dfds.com", { "email": "contractor@dfds.com", "expires": "2026-12-31" }]
+	"roles": [{ "roleName": "CloudEngineer", "scope": "Global", "expires": "2026-12-31" }]
+
+Access is valid through the given day (UTC). Once it has passed, the sync removes the membership or
+revokes the binding, even though it otherwise leaves members alone and never prunes. Entries expiring
+within expiryWarningDays (default 14) are warned about, and every upcoming expiry is listed after the sync.
+Expired access in protected groups and roles is still held back by the safeguards (see safeguards.go).
+*/
+
+const (
+	expiryDateLayout         = "2006-01-02"
+	defaultExpiryWarningDays = 14
+)
+
+type ExpiryDate struct {
+	time.Time
+}
+
+func (d *ExpiryDate) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(expiryDateLayout, strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("expires '%s' is not a date like 2026-12-31", value)
+	}
+	d.Time = parsed
+	return nil
+}
+
+func (d ExpiryDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Format(expiryDateLayout))
+}
+
+func (d ExpiryDate) String() string {
+	return d.Format(expiryDateLayout)
+}
+
+// expired reports whether the whole expiry day has passed.
+func (d *ExpiryDate) expired(now time.Time) bool {
+	return d != nil && !now.Before(d.AddDate(0, 0, 1))
+}
+
+// GroupMember is a member email with an optional expiry. In config.json it is either a plain string or
+// an object with email and expires.
+type GroupMember struct {
+	Email   string      `json:"email"`
+	Expires *ExpiryDate `json:"expires,omitempty"`
+}
+
+func (m *GroupMember) UnmarshalJSON(data []byte) error {
+	var email string
+	if err := json.Unmarshal(data, &email); err == nil {
+		m.Email, m.Expires = email, nil
+		return nil
+	}
+
+	type plain GroupMember
+	var member plain
+	if err := json.Unmarshal(data, &member); err != nil {
+		return fmt.Errorf("member must be an email or {\"email\", \"expires\"}: %w", err)
+	}
+	*m = GroupMember(member)
+	return nil
+}
+
+func (m GroupMember) MarshalJSON() ([]byte, error) {
+	if m.Expires == nil {
+		return json.Marshal(m.Email)
+	}
+	type plain GroupMember
+	return json.Marshal(plain(m))
+}
+
+// splitMembers separates members whose access is still valid from those whose access has expired.
+func splitMembers(members []GroupMember, now time.Time) (active, expired []string) {
+	for _, member := range members {
+		if member.Expires.expired(now) {
+			expired = append(expired, member.Email)
+		} else {
+			active = append(active, member.Email)
+		}
+	}
+	return active, expired
+}
+
+type expiryEntry struct {
+	Expires     ExpiryDate
+	Description string
+	Removal     Change // the change the sync makes once the entry has expired
+}
+
+// removed reports whether the applied changes include the removal of the expired entry.
+func (e expiryEntry) removed(applied []Change) bool {
+	for _, change := range applied {
+		if change.Expired && change.Action == e.Removal.Action && change.GroupName == e.Removal.GroupName &&
+			memberKey(change.Member) == memberKey(e.Removal.Member) && roleKey(change.RoleName) == roleKey(e.Removal.RoleName) &&
+			strings.EqualFold(change.Type, e.Removal.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// configExpirations lists every member and role binding in config.json that has an expiry date.
+func configExpirations(config *Config) []expiryEntry {
+	var entries []expiryEntry
+	for _, group := range resolveManagedGroups(config) {
+		for _, member := range group.Members {
+			if member.Expires != nil {
+				entries = append(entries, expiryEntry{
+					Expires:     *member.Expires,
+					Description: fmt.Sprintf("member '%s' of group '%s'", member.Email, group.Name),
+					Removal:     Change{Action: "remove-member", GroupName: group.Name, Member: member.Email},
+				})
+			}
+		}
+		for _, binding := range group.Roles {
+			if binding.Expires != nil {
+				scope := strings.TrimSpace(binding.Scope)
+				if scope == "" {
+					scope = "Global"
+				}
+				entries = append(entries, expiryEntry{
+					Expires:     *binding.Expires,
+					Description: fmt.Sprintf("role '%s' (%s) bound to group '%s'", binding.RoleName, binding.Scope, group.Name),
+					Removal:     Change{Action: "revoke-role", GroupName: group.Name, RoleName: binding.RoleName, Type: scope},
+				})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Expires.Before(entries[j].Expires.Time) })
+	return entries
+}
+
+// logExpiryReport warns about access that expires soon or has expired, and lists all upcoming expirations.
+// applied are the changes the sync made, to tell expired access it removed from access that was already gone.
+func logExpiryReport(config *Config, applied []Change, now time.Time) {
+	warningDays := config.ExpiryWarningDays
+	if warningDays <= 0 {
+		warningDays = defaultExpiryWarningDays
+	}
+
+	var upcoming []expiryEntry
+	for _, entry := range configExpirations(config) {
+		expires := entry.Expires
+		if expires.expired(now) {
+			if entry.removed(applied) {
+				log.Printf("- WARNING: %s expired on %s and was removed; delete the entry from config.json.", entry.Description, expires)
+			} else {
+				log.Printf("- WARNING: %s expired on %s and holds no access any more; delete the entry from config.json.", entry.Description, expires)
+			}
+			continue
+		}
+		days := int(expires.AddDate(0, 0, 1).Sub(now).Hours() / 24)
+		if days < warningDays {
+			log.Printf("- WARNING: %s expires on %s (in %d day(s)).", entry.Description, expires, days)
+		}
+		upcoming = append(upcoming, entry)
+	}
+
+	if len(upcoming) == 0 {
+		return
+	}
+	log.Println("Upcoming expirations:")
+	for _, entry := range upcoming {
+		log.Printf("  %s  %s", entry.Expires, entry.Description)
+	}
+}
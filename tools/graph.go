@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Access graph
+
+Renders members -> groups -> roles -> namespaces as Graphviz DOT or Mermaid. Group to role edges carry
+the binding scope, role to namespace edges the permissions the role holds in that namespace. The graph
+is drawn from the same state structure the sync and restore work on, so config.json and the live
+environment look the same.
+*/
+
+type graphNode struct {
+	ID    string
+	Label string
+	Kind  string // member, group, role or namespace
+}
+
+type graphEdge struct {
+	From  string
+	To    string
+	Label string
+}
+
+type AccessGraph struct {
+	Title string
+	Nodes []graphNode
+	Edges []graphEdge
+	ids   map[string]string // kind and label -> node ID
+	used  map[string]bool
+}
+
+// node returns the ID of the node for a label, adding it on first use. Roles and namespaces are matched
+// without case, like everywhere else, so a binding of 'reader' and the role 'Reader' are one node. Other
+// labels that only differ in case or punctuation map to the same identifier, so a later one gets a
+// counter suffix to stay a node of its own.
+func (g *AccessGraph) node(kind, label string) string {
+	key := kind + "|" + label
+	if kind == "role" || kind == "namespace" {
+		key = kind + "|" + roleKey(label)
+	}
+	if id, known := g.ids[key]; known {
+		return id
+	}
+
+	base := kind + "_" + graphIdentifier(label)
+	id := base
+	for n := 2; g.used[id]; n++ {
+		id = fmt.Sprintf("%s_%d", base, n)
+	}
+	g.ids[key] = id
+	g.used[id] = true
+	g.Nodes = append(g.Nodes, graphNode{ID: id, Label: label, Kind: kind})
+	return id
+}
+
+func (g *AccessGraph) edge(from, to, label string) {
+	g.Edges = append(g.Edges, graphEdge{From: from, To: to, Label: label})
+}
+
+// graphIdentifier keeps node IDs valid in both DOT and Mermaid, which are stricter than labels.
+func graphIdentifier(value string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(value) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// permissionsByNamespace groups grants into namespace -> sorted, comma separated permissions.
+func permissionsByNamespace(grants []PermissionGrant) map[string]string {
+	grouped := map[string][]string{}
+	for _, grant := range grants {
+		namespace := strings.ToLower(strings.TrimSpace(grant.Namespace))
+		grouped[namespace] = append(grouped[namespace], strings.ToLower(strings.TrimSpace(grant.Permission)))
+	}
+
+	labels := make(map[string]string, len(grouped))
+	for namespace, permissions := range grouped {
+		sort.Strings(permissions)
+		labels[namespace] = strings.Join(permissions, ", ")
+	}
+	return labels
+}
+
+func buildAccessGraph(state *RbacState, includeMembers bool) *AccessGraph {
+	graph := &AccessGraph{Title: state.Source, ids: map[string]string{}, used: map[string]bool{}}
+
+	// Role nodes are labelled with the name the role is defined under, not the one a binding spells.
+	roleNames := map[string]string{}
+	for _, role := range state.Roles {
+		roleNames[roleKey(role.Name)] = role.Name
+	}
+	roleLabel := func(name string) string {
+		if defined, found := roleNames[roleKey(name)]; found {
+			return defined
+		}
+		return name
+	}
+
+	// Only roles something is bound to are drawn, otherwise the catalogue of every role drowns the picture.
+	bound := map[string]bool{}
+	for _, group := range state.Groups {
+		groupNode := graph.node("group", group.Name)
+
+		if includeMembers {
+			for _, member := range group.Members {
+				graph.edge(graph.node("member", member), groupNode, "")
+			}
+		}
+		for _, grant := range group.RoleGrants {
+			scope := grant.Type
+			if grant.Resource != "" && grant.Resource != "*" {
+				scope = fmt.Sprintf("%s %s", grant.Type, grant.Resource)
+			}
+			graph.edge(groupNode, graph.node("role", roleLabel(grant.RoleName)), scope)
+			bound[roleKey(grant.RoleName)] = true
+		}
+		for _, permissions := range sortedLabels(permissionsByNamespace(group.Permissions)) {
+			graph.edge(groupNode, graph.node("namespace", permissions[0]), permissions[1])
+		}
+	}
+
+	for _, role := range state.Roles {
+		if !bound[roleKey(role.Name)] {
+			continue
+		}
+		roleNode := graph.node("role", role.Name)
+		for _, permissions := range sortedLabels(permissionsByNamespace(role.Permissions)) {
+			graph.edge(roleNode, graph.node("namespace", permissions[0]), permissions[1])
+		}
+	}
+
+	return graph
+}
+
+// sortedLabels returns namespace/label pairs in namespace order so the output is stable between runs.
+func sortedLabels(labels map[string]string) [][2]string {
+	pairs := make([][2]string, 0, len(labels))
+	for namespace, label := range labels {
+		pairs = append(pairs, [2]string{namespace, label})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	return pairs
+}
+
+/*
+Output formats
+*/
+
+var dotShapes = map[string]string{
+	"member":    "shape=ellipse, style=filled, fillcolor=\"#e3f2fd\"",
+	"group":     "shape=box, style=\"rounded,filled\", fillcolor=\"#c8e6c9\"",
+	"role":      "shape=box, style=filled, fillcolor=\"#fff3c4\"",
+	"namespace": "shape=note, style=filled, fillcolor=\"#eeeeee\"",
+}
+
+func dotQuote(value string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+}
+
+func writeGraphDOT(w io.Writer, graph *AccessGraph) error {
+	fmt.Fprintln(w, "digraph access {")
+	fmt.Fprintf(w, "    label=%s;\n", dotQuote("RBAC access graph ("+graph.Title+")"))
+	fmt.Fprintln(w, "    rankdir=LR;")
+	fmt.Fprintln(w, "    node [fontname=\"Helvetica\"];")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(w, "    %s [label=%s, %s];\n", node.ID, dotQuote(node.Label), dotShapes[node.Kind])
+	}
+	for _, edge := range graph.Edges {
+		if edge.Label == "" {
+			fmt.Fprintf(w, "    %s -> %s;\n", edge.From, edge.To)
+		} else {
+			fmt.Fprintf(w, "    %s -> %s [label=%s];\n", edge.From, edge.To, dotQuote(edge.Label))
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+var mermaidShapes = map[string][2]string{
+	"member":    {"([", "])"},
+	"group":     {"(", ")"},
+	"role":      {"[", "]"},
+	"namespace": {"[/", "/]"},
+}
+
+// Mermaid has no escaping inside labels beyond HTML entities, so quotes are replaced.
+func mermaidQuote(value string) string {
+	return "\"" + strings.ReplaceAll(value, "\"", "#quot;") + "\""
+}
+
+func writeGraphMermaid(w io.Writer, graph *AccessGraph) error {
+	fmt.Fprintln(w, "flowchart LR")
+	for _, node := range graph.Nodes {
+		shape := mermaidShapes[node.Kind]
+		fmt.Fprintf(w, "    %s%s%s%s\n", node.ID, shape[0], mermaidQuote(node.Label), shape[1])
+	}
+	for _, edge := range graph.Edges {
+		if edge.Label == "" {
+			fmt.Fprintf(w, "    %s --> %s\n", edge.From, edge.To)
+		} else {
+			fmt.Fprintf(w, "    %s -->|%s| %s\n", edge.From, mermaidQuote(edge.Label), edge.To)
+		}
+	}
+	fmt.Fprintln(w, "    classDef member fill:#e3f2fd")
+	fmt.Fprintln(w, "    classDef group fill:#c8e6c9")
+	fmt.Fprintln(w, "    classDef role fill:#fff3c4")
+	fmt.Fprintln(w, "    classDef namespace fill:#eeeeee")
+	for _, node := range graph.Nodes {
+		if _, err := fmt.Fprintf(w, "    class %s %s\n", node.ID, node.Kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Command
+*/
+
+func runGraph(config *Config, args []string) {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	live := flags.Bool("live", false, "draw the live environment instead of config.json")
+	format := flags.String("format", "mermaid", "mermaid or dot")
+	members := flags.Bool("members", false, "include group members")
+	outPath := flags.String("out", "", "output file (default stdout)")
+	flags.Parse(args)
+
+	writers := map[string]func(io.Writer, *AccessGraph) error{
+		"mermaid": writeGraphMermaid,
+		"dot":     writeGraphDOT,
+	}
+	write, known := writers[strings.ToLower(*format)]
+	if !known {
+		fatalf("unknown format '%s', expected mermaid or dot", *format)
+	}
+
+	state := desiredStateFromConfig(config)
+	if *live {
+		if err := readAccessToken(config); err != nil {
+			fatalf("%v", err)
+		}
+		var err error
+		if state, err = fetchState(config, false); err != nil {
+			fatalf("failed to fetch RBAC state: %v", err)
+		}
+	}
+
+	graph := buildAccessGraph(state, *members)
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fatalf("failed to create '%s': %v", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := write(out, graph); err != nil {
+		fatalf("failed to write access graph: %v", err)
+	}
+	if *outPath != "" {
+		log.Printf("Access graph (%d nodes, %d edges) written to '%s'.", len(graph.Nodes), len(graph.Edges), *outPath)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Checkpoint
+
+A backfill over every capability can die halfway, e.g. when the token expires or the API returns 502.
+After each capability the backfill writes its progress to a checkpoint file (--checkpoint, default
+backfill-checkpoint.json): the capabilities fully processed, and for those that failed the errors
+met. `backfill --resume` skips the processed capabilities and retries the failed ones.
+
+The checkpoint also records the mode (--reconcile or not) and the selection flags, and a resume with
+different ones is refused, as it would skip capabilities that were processed differently. A run without
+--resume will not overwrite the checkpoint of an earlier run unless --restart is given, so the retry list
+of an interrupted run is not lost by accident. A run that finishes without failures removes its
+checkpoint, as there is nothing left to resume.
+
+At the end the failed capabilities are printed as a retry list, ready for --ids. Dry runs change
+nothing, so they neither read nor write the checkpoint.
+*/
+
+const defaultCheckpointPath = "backfill-checkpoint.json"
+
+type CapabilityFailure struct {
+	Errors   []string  `json:"errors"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+type Checkpoint struct {
+	path      string
+	StartedAt time.Time                    `json:"startedAt"`
+	UpdatedAt time.Time                    `json:"updatedAt"`
+	Mode      string                       `json:"mode"` // backfill or reconcile
+	Selection CapabilityFilter             `json:"selection"`
+	Completed map[string]time.Time         `json:"completed"` // capability ID -> when it was processed
+	Failed    map[string]CapabilityFailure `json:"failed"`
+}
+
+func newCheckpoint(path, mode string, selection CapabilityFilter) *Checkpoint {
+	return &Checkpoint{
+		path:      path,
+		StartedAt: time.Now().UTC(),
+		Mode:      mode,
+		Selection: selection,
+		Completed: map[string]time.Time{},
+		Failed:    map[string]CapabilityFailure{},
+	}
+}
+
+func checkpointExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// loadCheckpoint reads the checkpoint of an earlier run, or starts a new one if there is none. It fails
+// if the earlier run used another mode or selection.
+func loadCheckpoint(path, mode string, selection CapabilityFilter) (*Checkpoint, error) {
+	file, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newCheckpoint(path, mode, selection), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := newCheckpoint(path, "", CapabilityFilter{})
+	if err := json.Unmarshal(file, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if checkpoint.Completed == nil {
+		checkpoint.Completed = map[string]time.Time{}
+	}
+	if checkpoint.Failed == nil {
+		checkpoint.Failed = map[string]CapabilityFailure{}
+	}
+
+	if checkpoint.Mode != mode {
+		return nil, fmt.Errorf("%s records mode '%s', this run is '%s'; resume with the same flags or start over with --restart", path, checkpoint.Mode, mode)
+	}
+	recorded, _ := json.Marshal(checkpoint.Selection)
+	requested, _ := json.Marshal(selection)
+	if string(recorded) != string(requested) {
+		return nil, fmt.Errorf("%s records selection %s, this run is %s; resume with the same flags or start over with --restart", path, recorded, requested)
+	}
+	return checkpoint, nil
+}
+
+func (c *Checkpoint) isCompleted(capabilityId string) bool {
+	_, completed := c.Completed[memberKey(capabilityId)]
+	return completed
+}
+
+// record notes the outcome of one capability and saves the checkpoint.
+func (c *Checkpoint) record(capabilityId string, errs []string) error {
+	now := time.Now().UTC()
+	if len(errs) == 0 {
+		c.Completed[memberKey(capabilityId)] = now
+		delete(c.Failed, memberKey(capabilityId))
+	} else {
+		c.Failed[memberKey(capabilityId)] = CapabilityFailure{Errors: errs, FailedAt: now}
+	}
+	c.UpdatedAt = now
+	return c.save()
+}
+
+// save writes the checkpoint to a temporary file first, so a run killed while saving keeps the previous one.
+func (c *Checkpoint) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(c.path+".tmp", c.path)
+}
+
+// finish removes the checkpoint of a run without failures, as there is nothing left to resume.
+func (c *Checkpoint) finish() error {
+	if len(c.Failed) > 0 {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (c *Checkpoint) retryList() []string {
+	ids := make([]string, 0, len(c.Failed))
+	for id := range c.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *Checkpoint) printRetryList() {
+	ids := c.retryList()
+	if len(ids) == 0 {
+		return
+	}
+
+	fmt.Println("")
+	fmt.Printf("Failed capabilities (details in %s):\n", c.path)
+	for _, id := range ids {
+		fmt.Printf("  %s: %s\n", id, strings.Join(c.Failed[id].Errors, "; "))
+	}
+	fmt.Printf("Retry them with --resume, or with --restart --ids %s\n", strings.Join(ids, ","))
+}
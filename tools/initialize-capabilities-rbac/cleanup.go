@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Cleanup of grants on deleted capabilities
+
+Deleting a capability leaves its capability-scoped role and permission grants (Type Capability,
+Resource <capability ID>) in place. They clutter /rbac/me and show up in access reviews. `cleanup` finds
+them for capabilities that are Deleted, and, by looking through the grants of every member and group,
+for capabilities that no longer exist at all. Only a grant whose resource is a well-formed capability ID
+counts as missing; grants with an empty, wildcard or malformed resource are reported and left alone.
+
+It first prints the plan, grouped by capability. With --revoke it then revokes the grants, unless the
+plan holds more than --max revocations (default 50, 0 for no limit): then nothing is revoked. With
+--warn-pending it also lists capabilities pending deletion, whose grants will be stale once deleted.
+*/
+
+const defaultMaxCleanupRevocations = 50
+
+// Capability IDs are lowercase names with a generated suffix, e.g. my-capability-abcde.
+var capabilityIdPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)+$`)
+
+type Grant struct {
+	ID                 string `json:"id"`
+	RoleId             string `json:"roleId"`     // role grants
+	Namespace          string `json:"namespace"`  // permission grants
+	Permission         string `json:"permission"` // permission grants
+	Type               string `json:"type"`
+	Resource           string `json:"resource"`
+	AssignedEntityType string `json:"assignedEntityType"`
+	AssignedEntityId   string `json:"assignedEntityId"`
+}
+
+type RbacGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type StaleGrant struct {
+	Kind         string // role or permission
+	Grant        Grant
+	CapabilityId string
+	Reason       string
+}
+
+func (s StaleGrant) describe(roleNames map[string]string) string {
+	what := s.Grant.Namespace + "/" + s.Grant.Permission
+	if s.Kind == "role" {
+		what = roleNames[strings.ToLower(s.Grant.RoleId)]
+		if what == "" {
+			what = s.Grant.RoleId
+		}
+	}
+	return fmt.Sprintf("%s grant %s: %s for %s %s", s.Kind, s.Grant.ID, what, strings.ToLower(s.Grant.AssignedEntityType), s.Grant.AssignedEntityId)
+}
+
+// fetchGrants fetches role or permission grants, e.g. fetchGrants(config, "permission", "user", id) for
+// GET /rbac/permission/user/{id}.
+func fetchGrants(config *Config, kind, scope, id string) ([]Grant, error) {
+	url := fmt.Sprintf("%s/rbac/%s/%s/%s", config.ApiUrl, kind, scope, id)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var grants []Grant
+	if err := json.NewDecoder(resp.Body).Decode(&grants); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+func fetchRbacGroups(config *Config) ([]RbacGroup, error) {
+	url := fmt.Sprintf("%s/rbac/groups", config.ApiUrl)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var groups []RbacGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func revokePermission(config *Config, grantId string) error {
+	url := fmt.Sprintf("%s/rbac/permission/revoke/%s", config.ApiUrl, grantId)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to revoke permission: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to revoke permission: %s, [error code %d]", string(b), resp.StatusCode)
+	}
+
+	return nil
+}
+
+// findStaleGrants collects the capability-scoped grants on deleted and missing capabilities. Grants that
+// could not be fetched are counted as failures.
+func findStaleGrants(config *Config, capabilities []Capability) ([]StaleGrant, int) {
+	existing := make(map[string]bool, len(capabilities))
+	var stale []StaleGrant
+	seen := map[string]bool{}
+	failures, malformed := 0, 0
+	add := func(kind string, grants []Grant, reason func(Grant) string) {
+		for _, grant := range grants {
+			if !strings.EqualFold(grant.Type, "capability") || seen[kind+"/"+grant.ID] {
+				continue
+			}
+			if r := reason(grant); r != "" {
+				seen[kind+"/"+grant.ID] = true
+				stale = append(stale, StaleGrant{Kind: kind, Grant: grant, CapabilityId: grant.Resource, Reason: r})
+			}
+		}
+	}
+
+	for _, c := range capabilities {
+		existing[memberKey(c.ID)] = true
+		if statusKey(c.Status) != "deleted" {
+			continue
+		}
+		for _, kind := range []string{"role", "permission"} {
+			grants, err := fetchGrants(config, kind, "capability", c.ID)
+			if err != nil {
+				log.Printf("failed to fetch %s grants for capability %s: %v", kind, c.ID, err)
+				failures++
+				continue
+			}
+			add(kind, grants, func(Grant) string { return "capability is deleted" })
+		}
+	}
+
+	// Grants on capabilities that no longer exist can only be found from the principals holding them.
+	missing := func(grant Grant) string {
+		if existing[memberKey(grant.Resource)] {
+			return ""
+		}
+		if !capabilityIdPattern.MatchString(grant.Resource) {
+			if !seen["malformed/"+grant.ID] {
+				seen["malformed/"+grant.ID] = true
+				malformed++
+			}
+			return ""
+		}
+		return "capability does not exist"
+	}
+	members, err := fetchAllMembers(config)
+	if err != nil {
+		log.Printf("failed to fetch members: %v", err)
+		failures++
+	}
+	groups, err := fetchRbacGroups(config)
+	if err != nil {
+		log.Printf("failed to fetch groups: %v", err)
+		failures++
+	}
+	fmt.Printf("Looking through the grants of %d members and %d groups\n", len(members), len(groups))
+
+	holders := make([][2]string, 0, len(members)+len(groups))
+	for _, m := range members {
+		holders = append(holders, [2]string{"user", m.Id})
+	}
+	for _, g := range groups {
+		holders = append(holders, [2]string{"group", g.ID})
+	}
+	for _, holder := range holders {
+		// role grants of groups live under /rbac/role/groups/{id}, permission grants under /rbac/permission/group/{id}
+		scopes := map[string]string{"role": holder[0], "permission": holder[0]}
+		if holder[0] == "group" {
+			scopes["role"] = "groups"
+		}
+		for _, kind := range []string{"role", "permission"} {
+			grants, err := fetchGrants(config, kind, scopes[kind], holder[1])
+			if err != nil {
+				log.Printf("failed to fetch %s grants for %s %s: %v", kind, holder[0], holder[1], err)
+				failures++
+				continue
+			}
+			add(kind, grants, missing)
+		}
+	}
+
+	if malformed > 0 {
+		fmt.Printf("- WARNING: %d capability grant(s) have no valid capability ID as resource, left alone\n", malformed)
+	}
+
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].CapabilityId < stale[j].CapabilityId })
+	return stale, failures
+}
+
+func runCleanup(config *Config, availableRoles map[string]string, args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	revoke := flags.Bool("revoke", false, "revoke the planned grants")
+	warnPending := flags.Bool("warn-pending", false, "also list capabilities pending deletion")
+	maxRevocations := flags.Int("max", defaultMaxCleanupRevocations, "revoke nothing if more grants than this are planned, 0 for no limit")
+	flags.Parse(args)
+
+	roleNames := make(map[string]string, len(availableRoles))
+	for name, id := range availableRoles {
+		roleNames[strings.ToLower(id)] = name
+	}
+
+	capabilities, err := fetchCapabilities(config)
+	if err != nil {
+		log.Fatalf("failed to fetch capabilities: %v", err)
+	}
+
+	if *warnPending {
+		for _, c := range capabilities {
+			if key := statusKey(c.Status); key == "pendingdeletion" || key == "ongoingdeletion" {
+				fmt.Printf("- WARNING: capability %s (%s) is %s, its grants will be stale once it is deleted\n", c.ID, c.Name, strings.ToLower(c.Status))
+			}
+		}
+	}
+
+	stale, failures := findStaleGrants(config, capabilities)
+
+	fmt.Println("")
+	fmt.Println("Plan:")
+	capabilityId := ""
+	for _, s := range stale {
+		if s.CapabilityId != capabilityId {
+			capabilityId = s.CapabilityId
+			fmt.Printf("  %s (%s):\n", s.CapabilityId, s.Reason)
+		}
+		fmt.Printf("    - revoke %s\n", s.describe(roleNames))
+	}
+	if len(stale) == 0 {
+		fmt.Println("  nothing to revoke")
+	}
+
+	if *revoke && *maxRevocations > 0 && len(stale) > *maxRevocations {
+		log.Fatalf("%d revocations planned, more than --max %d; nothing was revoked. Review the plan and raise --max to go ahead.", len(stale), *maxRevocations)
+	}
+
+	revocations := make([]Revocation, 0, len(stale))
+	for _, s := range stale {
+		revocations = append(revocations, Revocation{Principal: s.Grant.AssignedEntityId, Description: "revoke " + s.describe(roleNames)})
+	}
+	enforceSafeguards(config, revocations, !*revoke)
+
+	revoked := 0
+	if *revoke {
+		fmt.Println("")
+		for _, s := range stale {
+			var err error
+			if s.Kind == "role" {
+				err = revokeRole(config, s.Grant.ID)
+			} else {
+				err = revokePermission(config, s.Grant.ID)
+			}
+			if err != nil {
+				log.Printf("failed to revoke %s on %s: %v", s.describe(roleNames), s.CapabilityId, err)
+				failures++
+				continue
+			}
+			fmt.Printf("revoked %s on %s\n", s.describe(roleNames), s.CapabilityId)
+			revoked++
+		}
+	} else if len(stale) > 0 {
+		fmt.Println("Run with --revoke to revoke them.")
+	}
+
+	fmt.Println("")
+	fmt.Printf("Stale grants: %d, revoked: %d, failures: %d\n", len(stale), revoked, failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
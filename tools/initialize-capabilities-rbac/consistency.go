@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+Membership and capability role consistency
+
+The API keeps capability memberships and capability role grants in step when they change through
+role/grant and role/revoke, but memberships have no provenance, so changes made any other way leave
+them apart. `consistency` reports, per capability, members without any capability role and role grants
+held by users who are not members.
+
+With --fix each finding is resolved in the direction config.json gives:
+
+	"consistency": {
+	    "rolelessMembers": "grant:Reader",
+	    "grantsWithoutMembership": "revoke"
+	}
+
+rolelessMembers is grant:<role>, remove-membership or report; grantsWithoutMembership is revoke,
+add-membership or report. report, the default, leaves the finding alone.
+*/
+
+type ConsistencyFix struct {
+	RolelessMembers         string `json:"rolelessMembers"`
+	GrantsWithoutMembership string `json:"grantsWithoutMembership"`
+}
+
+type Inconsistency struct {
+	CapabilityId string
+	UserId       string
+	Grant        *RoleAssignment // set for grants without membership
+	RoleName     string
+}
+
+func (i Inconsistency) String() string {
+	if i.Grant != nil {
+		return fmt.Sprintf("%s holds %s on %s but is not a member", i.UserId, i.RoleName, i.CapabilityId)
+	}
+	return fmt.Sprintf("%s is a member of %s without a capability role", i.UserId, i.CapabilityId)
+}
+
+// checkConsistency compares a capability's members with its user role grants.
+func checkConsistency(c Capability, members []Member, grants []RoleAssignment, roleNames map[string]string) []Inconsistency {
+	isMember := make(map[string]bool, len(members))
+	for _, m := range members {
+		isMember[memberKey(m.Id)] = true
+	}
+
+	var findings []Inconsistency
+	hasRole := make(map[string]bool)
+	for i, grant := range grants {
+		if !strings.EqualFold(grant.AssignedEntityType, "User") {
+			continue
+		}
+		hasRole[memberKey(grant.AssignedEntityId)] = true
+		if !isMember[memberKey(grant.AssignedEntityId)] {
+			findings = append(findings, Inconsistency{
+				CapabilityId: c.ID,
+				UserId:       grant.AssignedEntityId,
+				Grant:        &grants[i],
+				RoleName:     roleNames[strings.ToLower(grant.RoleId)],
+			})
+		}
+	}
+	for _, m := range members {
+		if !hasRole[memberKey(m.Id)] {
+			findings = append(findings, Inconsistency{CapabilityId: c.ID, UserId: m.Id})
+		}
+	}
+
+	return findings
+}
+
+// fixAction describes what the configured direction does about a finding, or "" when it is only reported.
+func fixAction(fix ConsistencyFix, finding Inconsistency) (string, error) {
+	if finding.Grant != nil {
+		switch strings.ToLower(strings.TrimSpace(fix.GrantsWithoutMembership)) {
+		case "", "report":
+			return "", nil
+		case "revoke":
+			return fmt.Sprintf("revoke %s on %s from %s (grant %s)", finding.RoleName, finding.CapabilityId, finding.UserId, finding.Grant.ID), nil
+		case "add-membership":
+			return fmt.Sprintf("add %s as member of %s", finding.UserId, finding.CapabilityId), nil
+		}
+		return "", fmt.Errorf("unknown grantsWithoutMembership direction '%s', expected revoke, add-membership or report", fix.GrantsWithoutMembership)
+	}
+
+	direction := strings.ToLower(strings.TrimSpace(fix.RolelessMembers))
+	switch {
+	case direction == "" || direction == "report":
+		return "", nil
+	case strings.HasPrefix(direction, "grant:"):
+		return fmt.Sprintf("grant %s on %s to %s", strings.TrimPrefix(direction, "grant:"), finding.CapabilityId, finding.UserId), nil
+	case direction == "remove-membership":
+		return fmt.Sprintf("remove %s from %s", finding.UserId, finding.CapabilityId), nil
+	}
+	return "", fmt.Errorf("unknown rolelessMembers direction '%s', expected grant:<role>, remove-membership or report", fix.RolelessMembers)
+}
+
+// takesAccessAway reports whether the configured direction revokes a finding's grant or removes its
+// membership.
+func takesAccessAway(fix ConsistencyFix, finding Inconsistency) bool {
+	if finding.Grant != nil {
+		return strings.EqualFold(strings.TrimSpace(fix.GrantsWithoutMembership), "revoke")
+	}
+	return strings.EqualFold(strings.TrimSpace(fix.RolelessMembers), "remove-membership")
+}
+
+// validateConsistencyFix checks the configured directions before any capability is looked at.
+func validateConsistencyFix(fix ConsistencyFix, availableRoles map[string]string) error {
+	if _, err := fixAction(fix, Inconsistency{}); err != nil {
+		return err
+	}
+	if _, err := fixAction(fix, Inconsistency{Grant: &RoleAssignment{}}); err != nil {
+		return err
+	}
+	if direction := strings.ToLower(strings.TrimSpace(fix.RolelessMembers)); strings.HasPrefix(direction, "grant:") {
+		if _, exists := availableRoles[strings.TrimPrefix(direction, "grant:")]; !exists {
+			return fmt.Errorf("rolelessMembers grants role '%s', which is not an assignable role", strings.TrimPrefix(direction, "grant:"))
+		}
+	}
+	return nil
+}
+
+func applyFix(config *Config, finding Inconsistency, availableRoles map[string]string) error {
+	if finding.Grant != nil {
+		if strings.EqualFold(strings.TrimSpace(config.Consistency.GrantsWithoutMembership), "revoke") {
+			return revokeRole(config, finding.Grant.ID)
+		}
+		return addMembership(config, finding.UserId, finding.CapabilityId)
+	}
+
+	direction := strings.ToLower(strings.TrimSpace(config.Consistency.RolelessMembers))
+	if strings.HasPrefix(direction, "grant:") {
+		return assignRole(config, finding.CapabilityId, finding.UserId, strings.TrimPrefix(direction, "grant:"), availableRoles)
+	}
+	return removeMembership(config, finding.UserId, finding.CapabilityId)
+}
+
+func addMembership(config *Config, userId, capabilityId string) error {
+	url := fmt.Sprintf("%s/rbac/members/%s/memberships", config.ApiUrl, userId)
+	body, _ := json.Marshal(map[string]string{"capabilityId": capabilityId})
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to add membership: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to add membership: %s, [error code %d]", string(b), resp.StatusCode)
+	}
+
+	return nil
+}
+
+func removeMembership(config *Config, userId, capabilityId string) error {
+	url := fmt.Sprintf("%s/rbac/members/%s/memberships/%s", config.ApiUrl, userId, capabilityId)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to remove membership: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to remove membership: %s, [error code %d]", string(b), resp.StatusCode)
+	}
+
+	return nil
+}
+
+func runConsistency(config *Config, availableRoles map[string]string, args []string) {
+	flags := flag.NewFlagSet("consistency", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "resolve findings in the direction configured in config.json")
+	dryRun := flags.Bool("dry-run", false, "with --fix, only print the fixes")
+	getFilter := addFilterFlags(flags)
+	flags.Parse(args)
+
+	if err := validateConsistencyFix(config.Consistency, availableRoles); err != nil {
+		log.Fatalf("invalid consistency configuration: %v", err)
+	}
+
+	roleNames := make(map[string]string, len(availableRoles))
+	for name, id := range availableRoles {
+		roleNames[strings.ToLower(id)] = name
+	}
+
+	filter, err := getFilter()
+	if err != nil {
+		log.Fatalf("invalid selection: %v", err)
+	}
+	capabilities, _, err := fetchSelectedCapabilities(config, filter)
+	if err != nil {
+		log.Fatalf("failed to fetch capabilities: %v", err)
+	}
+
+	// Every capability is checked before anything is fixed, so the fixes can be held to the safeguards.
+	var findings []Inconsistency
+	failures := 0
+	for _, c := range capabilities {
+		members, err := fetchMembers(config, c.ID)
+		if err != nil {
+			log.Printf("failed to fetch members for capability %s: %v", c.ID, err)
+			failures++
+			continue
+		}
+		grants, err := fetchCapabilityRoleGrants(config, c.ID)
+		if err != nil {
+			log.Printf("failed to fetch role grants for capability %s: %v", c.ID, err)
+			failures++
+			continue
+		}
+
+		for _, finding := range checkConsistency(c, members, grants, roleNames) {
+			findings = append(findings, finding)
+			fmt.Printf("- %s\n", finding)
+		}
+	}
+
+	fixed := 0
+	if *fix {
+		var revocations []Revocation
+		for _, finding := range findings {
+			if takesAccessAway(config.Consistency, finding) {
+				action, _ := fixAction(config.Consistency, finding)
+				revocations = append(revocations, Revocation{Principal: finding.UserId, Description: action})
+			}
+		}
+		enforceSafeguards(config, revocations, *dryRun)
+
+		fmt.Println("")
+		for _, finding := range findings {
+			action, _ := fixAction(config.Consistency, finding)
+			if action == "" {
+				continue
+			}
+			if *dryRun {
+				fmt.Printf("would %s\n", action)
+				continue
+			}
+			if err := applyFix(config, finding, availableRoles); err != nil {
+				log.Printf("failed to %s: %v", action, err)
+				failures++
+				continue
+			}
+			fmt.Printf("%s\n", action)
+			fixed++
+		}
+	}
+
+	fmt.Println("")
+	fmt.Printf("Inconsistencies: %d, fixed: %d, failures: %d\n", len(findings), fixed, failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Orphaned capabilities
+
+A capability is orphaned when nobody who is still a member holds Owner on it: the Owner grant was never
+made, dfds.owner is empty, or the owner left and lost their membership or account. Without an owner
+nobody can approve membership applications or request deletion.
+
+`orphans` reports them with their members and when those were last seen. With --promote it grants
+Owner to one active member picked by the rule in config.json:
+
+	"orphans": { "promotionRule": "longest-standing", "activeDays": 90 }
+
+longest-standing picks the member with the oldest membership, most-recently-seen the member seen last.
+Members not seen within activeDays are never promoted.
+*/
+
+const defaultOrphanActiveDays = 90
+
+type OrphanPromotion struct {
+	Rule       string `json:"promotionRule"` // longest-standing (default) or most-recently-seen
+	ActiveDays int    `json:"activeDays"`
+}
+
+type MemberSummary struct {
+	Id          string     `json:"id"`
+	Email       string     `json:"email"`
+	DisplayName string     `json:"displayName"`
+	Type        string     `json:"type"`
+	LastSeen    *time.Time `json:"lastSeen"`
+}
+
+type CapabilityMembership struct {
+	CapabilityId string    `json:"capabilityId"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type OrphanedCapability struct {
+	Capability Capability
+	Reasons    []string
+	Members    []Member
+}
+
+func memberKey(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// fetchAllMembers pages through GET /rbac/members and returns every user and service principal.
+func fetchAllMembers(config *Config) ([]MemberSummary, error) {
+	const pageSize = 200
+
+	var members []MemberSummary
+	for offset := 0; ; offset += pageSize {
+		url := fmt.Sprintf("%s/rbac/members?type=All&limit=%d&offset=%d", config.ApiUrl, pageSize, offset)
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+		}
+
+		var page struct {
+			Items []MemberSummary `json:"items"`
+			Total int             `json:"total"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, page.Items...)
+		if len(page.Items) < pageSize || len(members) >= page.Total {
+			return members, nil
+		}
+	}
+}
+
+func fetchMemberships(config *Config, userId string) ([]CapabilityMembership, error) {
+	url := fmt.Sprintf("%s/rbac/members/%s/memberships", config.ApiUrl, userId)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var memberships []CapabilityMembership
+	if err := json.NewDecoder(resp.Body).Decode(&memberships); err != nil {
+		return nil, err
+	}
+
+	return memberships, nil
+}
+
+// findOrphan returns why a capability has no owner, or nil when a current member holds Owner.
+func findOrphan(c Capability, members []Member, grants []RoleAssignment, known map[string]*MemberSummary,
+	availableRoles map[string]string) *OrphanedCapability {
+	isMember := make(map[string]bool, len(members))
+	for _, m := range members {
+		isMember[memberKey(m.Id)] = true
+	}
+
+	var formerOwners []string
+	for _, grant := range grants {
+		if !strings.EqualFold(grant.AssignedEntityType, "User") || !strings.EqualFold(grant.RoleId, availableRoles["owner"]) {
+			continue
+		}
+		if isMember[memberKey(grant.AssignedEntityId)] && known[memberKey(grant.AssignedEntityId)] != nil {
+			return nil
+		}
+		formerOwners = append(formerOwners, grant.AssignedEntityId)
+	}
+
+	orphan := &OrphanedCapability{Capability: c, Members: members}
+	if len(formerOwners) == 0 {
+		orphan.Reasons = append(orphan.Reasons, "no principal holds Owner")
+	} else {
+		orphan.Reasons = append(orphan.Reasons, fmt.Sprintf("Owner only held by former members or removed accounts: %s", strings.Join(formerOwners, ", ")))
+	}
+
+	var metadata map[string]interface{}
+	metadataErr := json.Unmarshal([]byte(c.JsonMetadata), &metadata)
+	namedOwners := metadataStrings(metadata["dfds.owner"])
+	switch {
+	case metadataErr != nil:
+		orphan.Reasons = append(orphan.Reasons, fmt.Sprintf("metadata could not be parsed: %v", metadataErr))
+	case len(namedOwners) == 0:
+		orphan.Reasons = append(orphan.Reasons, "dfds.owner is empty")
+	}
+	for _, owner := range namedOwners {
+		if !isMember[memberKey(owner)] {
+			orphan.Reasons = append(orphan.Reasons, fmt.Sprintf("dfds.owner %s is not a member", owner))
+		}
+	}
+	if len(members) == 0 {
+		orphan.Reasons = append(orphan.Reasons, "capability has no members")
+	}
+
+	return orphan
+}
+
+func describeLastSeen(summary *MemberSummary) string {
+	switch {
+	case summary == nil:
+		return "unknown account"
+	case summary.LastSeen == nil:
+		return "never seen"
+	}
+	return "last seen " + summary.LastSeen.UTC().Format("2006-01-02")
+}
+
+// promotionCandidate picks the member to promote according to the configured rule, or "" if no member
+// has been active recently enough.
+func promotionCandidate(config *Config, orphan *OrphanedCapability, known map[string]*MemberSummary, now time.Time) (string, error) {
+	activeDays := config.Orphans.ActiveDays
+	if activeDays <= 0 {
+		activeDays = defaultOrphanActiveDays
+	}
+
+	var active []*MemberSummary
+	for _, m := range orphan.Members {
+		summary := known[memberKey(m.Id)]
+		if summary != nil && summary.LastSeen != nil && now.Sub(*summary.LastSeen) <= time.Duration(activeDays)*24*time.Hour {
+			active = append(active, summary)
+		}
+	}
+	if len(active) == 0 {
+		return "", nil
+	}
+
+	switch strings.ToLower(config.Orphans.Rule) {
+	case "most-recently-seen":
+		sort.SliceStable(active, func(i, j int) bool { return active[i].LastSeen.After(*active[j].LastSeen) })
+		return active[0].Id, nil
+	case "", "longest-standing":
+		since := make(map[string]time.Time, len(active))
+		for _, summary := range active {
+			memberships, err := fetchMemberships(config, summary.Id)
+			if err != nil {
+				return "", fmt.Errorf("memberships of %s: %w", summary.Id, err)
+			}
+			for _, membership := range memberships {
+				if strings.EqualFold(membership.CapabilityId, orphan.Capability.ID) {
+					since[summary.Id] = membership.CreatedAt
+				}
+			}
+		}
+		sort.SliceStable(active, func(i, j int) bool {
+			a, aKnown := since[active[i].Id]
+			b, bKnown := since[active[j].Id]
+			if aKnown != bKnown {
+				return aKnown
+			}
+			return a.Before(b)
+		})
+		return active[0].Id, nil
+	default:
+		return "", fmt.Errorf("unknown promotion rule '%s', expected longest-standing or most-recently-seen", config.Orphans.Rule)
+	}
+}
+
+func runOrphans(config *Config, availableRoles map[string]string, args []string) {
+	flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+	promote := flags.Bool("promote", false, "grant Owner to the member picked by the configured promotion rule")
+	dryRun := flags.Bool("dry-run", false, "with --promote, only print who would be promoted")
+	getFilter := addFilterFlags(flags)
+	flags.Parse(args)
+
+	filter, err := getFilter()
+	if err != nil {
+		log.Fatalf("invalid selection: %v", err)
+	}
+	capabilities, _, err := fetchSelectedCapabilities(config, filter)
+	if err != nil {
+		log.Fatalf("failed to fetch capabilities: %v", err)
+	}
+	allMembers, err := fetchAllMembers(config)
+	if err != nil {
+		log.Fatalf("failed to fetch members: %v", err)
+	}
+	known := make(map[string]*MemberSummary, len(allMembers))
+	for i := range allMembers {
+		known[memberKey(allMembers[i].Id)] = &allMembers[i]
+	}
+
+	now := time.Now().UTC()
+	orphans, promoted, failures := 0, 0, 0
+	for _, c := range capabilities {
+		members, err := fetchMembers(config, c.ID)
+		if err != nil {
+			log.Printf("failed to fetch members for capability %s: %v", c.ID, err)
+			failures++
+			continue
+		}
+		grants, err := fetchCapabilityRoleGrants(config, c.ID)
+		if err != nil {
+			log.Printf("failed to fetch role grants for capability %s: %v", c.ID, err)
+			failures++
+			continue
+		}
+
+		orphan := findOrphan(c, members, grants, known, availableRoles)
+		if orphan == nil {
+			continue
+		}
+		orphans++
+
+		fmt.Printf("Orphaned capability: %s (%s)\n", c.ID, c.Name)
+		for _, reason := range orphan.Reasons {
+			fmt.Printf("  - %s\n", reason)
+		}
+		for _, m := range members {
+			fmt.Printf("  member %s, %s\n", m.Id, describeLastSeen(known[memberKey(m.Id)]))
+		}
+
+		if !*promote {
+			continue
+		}
+		candidate, err := promotionCandidate(config, orphan, known, now)
+		if err != nil {
+			log.Printf("failed to pick an owner for capability %s: %v", c.ID, err)
+			failures++
+			continue
+		}
+		if candidate == "" {
+			fmt.Println("  no active member to promote, please assign an owner manually")
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("  would grant owner on %s to %s\n", c.ID, candidate)
+			continue
+		}
+		if err := assignRole(config, c.ID, candidate, "owner", availableRoles); err != nil {
+			log.Printf("failed to grant owner on %s to %s: %v", c.ID, candidate, err)
+			failures++
+			continue
+		}
+		fmt.Printf("  granted owner on %s to %s\n", c.ID, candidate)
+		promoted++
+	}
+
+	fmt.Println("")
+	fmt.Printf("Orphaned capabilities: %d, promoted: %d, failures: %d\n", orphans, promoted, failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
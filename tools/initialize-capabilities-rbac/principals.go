@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+Principals named in metadata
+
+Metadata holds owners and other principals as typed by people: an email or UPN in any case, a list of
+them, or an object such as {"email": "..."}. Each one is looked up as a member ID with GET
+/rbac/members/{id} and otherwise searched for with GET /rbac/members?search=, which matches parts of
+emails and display names, so the results are paged through until one matches the ID or email exactly.
+What happens to principals that match nobody, and to owners who are not members of the capability, is
+set in config.json:
+
+	"owners": { "unknown": "skip", "nonMember": "grant" }
+
+unknown is provision (register them with POST /rbac/members), skip (the default), or all-members-owner
+(skip them, and when none of the named owners is known make every member Owner). Under skip, members
+then get the rule's defaultRole; unownedDefaultRole is only for metadata naming no owner (see rules.go). nonMember is grant
+(the default; granting a capability role also makes them a member) or skip. Every decision is printed
+with the capability.
+*/
+
+type OwnerPolicy struct {
+	Unknown   string `json:"unknown"`
+	NonMember string `json:"nonMember"`
+}
+
+func (p OwnerPolicy) validate() error {
+	switch strings.ToLower(p.Unknown) {
+	case "", "provision", "skip", "all-members-owner":
+	default:
+		return fmt.Errorf("unknown owners policy '%s', expected provision, skip or all-members-owner", p.Unknown)
+	}
+	switch strings.ToLower(p.NonMember) {
+	case "", "grant", "skip":
+	default:
+		return fmt.Errorf("non-member owners policy '%s', expected grant or skip", p.NonMember)
+	}
+	return nil
+}
+
+// PrincipalResolver maps metadata values to member IDs, caching lookups across capabilities.
+type PrincipalResolver struct {
+	config *Config
+	dryRun bool
+	cache  map[string]string // memberKey(value) -> member ID, "" when unknown
+}
+
+func newPrincipalResolver(config *Config, dryRun bool) *PrincipalResolver {
+	return &PrincipalResolver{config: config, dryRun: dryRun, cache: map[string]string{}}
+}
+
+// Resolve returns the member ID a metadata value refers to, or "" if it matches no member.
+func (r *PrincipalResolver) Resolve(value string) (string, error) {
+	if id, cached := r.cache[memberKey(value)]; cached {
+		return id, nil
+	}
+
+	member, err := fetchMember(r.config, value)
+	if err != nil {
+		return "", err
+	}
+	if member != nil {
+		r.cache[memberKey(value)] = member.Id
+		return member.Id, nil
+	}
+
+	id := ""
+	for offset := 0; ; offset += memberSearchPageSize {
+		candidates, total, err := searchMembers(r.config, value, offset)
+		if err != nil {
+			return "", err
+		}
+		for _, candidate := range candidates {
+			if memberKey(candidate.Id) == memberKey(value) || memberKey(candidate.Email) == memberKey(value) {
+				if id != "" && memberKey(id) != memberKey(candidate.Id) {
+					return "", fmt.Errorf("'%s' matches both %s and %s", value, id, candidate.Id)
+				}
+				id = candidate.Id
+			}
+		}
+		if id != "" || len(candidates) < memberSearchPageSize || offset+len(candidates) >= total {
+			break
+		}
+	}
+
+	r.cache[memberKey(value)] = id
+	return id, nil
+}
+
+// Provision registers an unknown principal as a member. In a dry run nothing is registered.
+func (r *PrincipalResolver) Provision(value string) (string, error) {
+	if r.dryRun {
+		return value, nil
+	}
+	member, err := provisionMember(r.config, value)
+	if err != nil {
+		return "", err
+	}
+	r.cache[memberKey(value)] = member.Id
+	return member.Id, nil
+}
+
+// fetchMember looks a member up by ID, returning nil if there is none.
+func fetchMember(config *Config, id string) (*MemberSummary, error) {
+	path := url.PathEscape(strings.TrimSpace(id))
+	url := fmt.Sprintf("%s/rbac/members/%s", config.ApiUrl, path)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var member MemberSummary
+	if err := json.NewDecoder(resp.Body).Decode(&member); err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+const memberSearchPageSize = 50
+
+// searchMembers returns one page of the members whose email or display name contains search, and the
+// total number of matches.
+func searchMembers(config *Config, search string, offset int) ([]MemberSummary, int, error) {
+	query := url.QueryEscape(strings.TrimSpace(search))
+	url := fmt.Sprintf("%s/rbac/members?type=All&limit=%d&offset=%d&search=%s", config.ApiUrl, memberSearchPageSize, offset, query)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var page struct {
+		Items []MemberSummary `json:"items"`
+		Total int             `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, 0, err
+	}
+
+	return page.Items, page.Total, nil
+}
+
+func provisionMember(config *Config, id string) (*MemberSummary, error) {
+	url := fmt.Sprintf("%s/rbac/members", config.ApiUrl)
+	body, _ := json.Marshal(map[string]string{"id": strings.TrimSpace(id), "email": strings.TrimSpace(id)})
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to provision member: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to provision member: %s, [error code %d]", string(b), resp.StatusCode)
+	}
+
+	var member MemberSummary
+	if err := json.NewDecoder(resp.Body).Decode(&member); err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
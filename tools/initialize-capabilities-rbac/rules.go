@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Role rules
+
+Which capability role each member gets is decided by the first rule whose conditions match the
+capability's JsonMetadata. A rule maps metadata keys holding principals (see principals.go) to roles,
+and gives every other member a default role. Rules are read from the file config.json names in
+"roleRules", see role-rules_skeleton.json; without one the built-in rule below applies:
+
+	{ "name": "default", "roles": { "dfds.owner": "Owner" }, "defaultRole": "Contributor", "unownedDefaultRole": "Owner" }
+
+"when" holds the metadata conditions: each key must have one of the listed values (compared without
+case), or any non-empty value for "*". A member named under several keys gets each of those roles.
+
+unownedDefaultRole only applies when the metadata names no Owner at all. When it names owners who are
+all unknown, the other members get defaultRole under the skip policy; only all-members-owner makes
+every member Owner then.
+*/
+
+type RoleRule struct {
+	Name               string                 `json:"name"`
+	When               map[string]interface{} `json:"when"`
+	Roles              map[string]string      `json:"roles"`              // metadata key -> role
+	DefaultRole        string                 `json:"defaultRole"`        // for members not named in metadata
+	UnownedDefaultRole string                 `json:"unownedDefaultRole"` // instead of defaultRole when metadata names no Owner at all
+}
+
+type RoleRulesFile struct {
+	Rules []RoleRule `json:"rules"`
+}
+
+var defaultRoleRules = []RoleRule{{
+	Name:               "default",
+	Roles:              map[string]string{"dfds.owner": "Owner"},
+	DefaultRole:        "Contributor",
+	UnownedDefaultRole: "Owner",
+}}
+
+// loadRoleRules reads a rules file and checks every role it mentions is assignable. An empty path gives
+// the built-in rule.
+func loadRoleRules(path string, availableRoles map[string]string) ([]RoleRule, error) {
+	if path == "" {
+		return defaultRoleRules, nil
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rulesFile RoleRulesFile
+	if err := json.Unmarshal(file, &rulesFile); err != nil {
+		return nil, err
+	}
+	if len(rulesFile.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", path)
+	}
+
+	for i, rule := range rulesFile.Rules {
+		if rule.Name == "" {
+			rulesFile.Rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+		roles := []string{rule.DefaultRole, rule.UnownedDefaultRole}
+		for _, role := range rule.Roles {
+			roles = append(roles, role)
+		}
+		for _, role := range roles {
+			if _, exists := availableRoles[strings.ToLower(role)]; role != "" && !exists {
+				return nil, fmt.Errorf("rule '%s' uses role '%s', which is not an assignable role", rulesFile.Rules[i].Name, role)
+			}
+		}
+	}
+
+	return rulesFile.Rules, nil
+}
+
+// metadataStrings flattens a metadata value into its string values.
+func metadataStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return nil
+		}
+		return []string{strings.TrimSpace(v)}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, metadataStrings(item)...)
+		}
+		return values
+	case map[string]interface{}:
+		// A principal written as an object, e.g. {"name": "...", "email": "..."}
+		for _, key := range []string{"email", "upn", "userPrincipalName", "id"} {
+			if values := metadataStrings(v[key]); len(values) > 0 {
+				return values
+			}
+		}
+		return nil
+	case nil:
+		return nil
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+func parseMetadata(c Capability) (map[string]interface{}, error) {
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(c.JsonMetadata), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+func (r RoleRule) matches(metadata map[string]interface{}) bool {
+	return metadataMatches(r.When, metadata)
+}
+
+// metadataMatches reports whether every key in conditions has one of the accepted values, or any
+// non-empty value for "*".
+func metadataMatches(conditions map[string]interface{}, metadata map[string]interface{}) bool {
+	for key, accepted := range conditions {
+		values := metadataStrings(metadata[key])
+		if len(values) == 0 {
+			return false
+		}
+		acceptedValues := metadataStrings(accepted)
+		if len(acceptedValues) == 1 && acceptedValues[0] == "*" {
+			continue
+		}
+		matched := false
+		for _, value := range values {
+			for _, acceptedValue := range acceptedValues {
+				matched = matched || strings.EqualFold(value, acceptedValue)
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchRoleRule(rules []RoleRule, metadata map[string]interface{}) *RoleRule {
+	for i := range rules {
+		if rules[i].matches(metadata) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// desiredGrants applies the first matching role rule to a capability. Principals named in metadata are
+// resolved to member IDs under the owner policy (see principals.go), and each decision is returned for the
+// report. It also returns the principals the rule makes Owner, which --reconcile keeps as the only owners.
+func desiredGrants(c Capability, members []Member, rules []RoleRule, policy OwnerPolicy, resolver *PrincipalResolver) ([]DesiredGrant, []string, []string, error) {
+	metadata, err := parseMetadata(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rule := matchRoleRule(rules, metadata)
+	if rule == nil {
+		return nil, nil, nil, fmt.Errorf("no role rule matches its metadata")
+	}
+
+	isMember := make(map[string]bool, len(members))
+	for _, m := range members {
+		isMember[memberKey(m.Id)] = true
+	}
+
+	keys := make([]string, 0, len(rule.Roles))
+	for key := range rule.Roles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var grants []DesiredGrant
+	var owners, decisions []string
+	named := map[string]bool{}
+	ownersNamed := false
+	for _, key := range keys {
+		role := strings.ToLower(rule.Roles[key])
+		for _, value := range metadataStrings(metadata[key]) {
+			ownersNamed = ownersNamed || role == "owner"
+
+			id, err := resolver.Resolve(value)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to resolve %s '%s': %w", key, value, err)
+			}
+			switch {
+			case id == "" && strings.EqualFold(policy.Unknown, "provision"):
+				if id, err = resolver.Provision(value); err != nil {
+					return nil, nil, nil, fmt.Errorf("failed to provision %s '%s': %w", key, value, err)
+				}
+				decisions = append(decisions, fmt.Sprintf("%s '%s' is unknown, provisioned as a member", key, value))
+			case id == "":
+				decisions = append(decisions, fmt.Sprintf("%s '%s' is unknown, skipped", key, value))
+				continue
+			case id != value:
+				decisions = append(decisions, fmt.Sprintf("%s '%s' resolved to %s", key, value, id))
+			}
+
+			if role == "owner" && !isMember[memberKey(id)] {
+				if strings.EqualFold(policy.NonMember, "skip") {
+					decisions = append(decisions, fmt.Sprintf("owner %s is not a member, skipped", id))
+					continue
+				}
+				decisions = append(decisions, fmt.Sprintf("owner %s is not a member, granting Owner makes them one", id))
+			}
+
+			named[memberKey(id)] = true
+			grants = append(grants, DesiredGrant{UserId: id, RoleName: role})
+			if role == "owner" {
+				owners = append(owners, id)
+			}
+		}
+	}
+
+	defaultRole := rule.DefaultRole
+	if !ownersNamed && rule.UnownedDefaultRole != "" {
+		defaultRole = rule.UnownedDefaultRole
+	}
+	if len(owners) == 0 && ownersNamed {
+		if strings.EqualFold(policy.Unknown, "all-members-owner") {
+			defaultRole = "owner"
+			decisions = append(decisions, "none of the named owners is known, every member gets Owner")
+		} else if defaultRole != "" {
+			decisions = append(decisions, fmt.Sprintf("none of the named owners is known, other members get %s", strings.ToLower(defaultRole)))
+		}
+	}
+	if defaultRole != "" {
+		for _, m := range members {
+			if !named[memberKey(m.Id)] {
+				grants = append(grants, DesiredGrant{UserId: m.Id, RoleName: strings.ToLower(defaultRole)})
+			}
+		}
+	}
+
+	return grants, owners, decisions, nil
+}
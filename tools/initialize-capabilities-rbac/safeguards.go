@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+Safeguards
+
+The commands that take access away, backfill --reconcile, consistency --fix and cleanup --revoke, plan
+every selected capability first and check the plan against these limits before the first write, like the
+safeguards of the baseline tool. A bad rule or metadata value then aborts the run instead of
+half-applying it. maxRevocations counts revoked grants and removed memberships; 0 means no limit.
+
+	"safeguards": {
+	    "maxRevocations": 25,
+	    "protectedPrincipals": ["someone@dfds.com"]
+	}
+
+Dry runs print the violations but change nothing either way.
+*/
+
+type Safeguards struct {
+	MaxRevocations      int      `json:"maxRevocations"`
+	ProtectedPrincipals []string `json:"protectedPrincipals"`
+}
+
+// Revocation is a grant or membership a run is about to take away from a principal.
+type Revocation struct {
+	Principal   string
+	Description string
+}
+
+// checkSafeguards returns every way the revocations break the configured safeguards.
+func checkSafeguards(safeguards Safeguards, revocations []Revocation) []string {
+	var violations []string
+	for _, revocation := range revocations {
+		for _, protected := range safeguards.ProtectedPrincipals {
+			if memberKey(protected) == memberKey(revocation.Principal) {
+				violations = append(violations, fmt.Sprintf("principal '%s' is protected: %s", revocation.Principal, revocation.Description))
+				break
+			}
+		}
+	}
+	if safeguards.MaxRevocations > 0 && len(revocations) > safeguards.MaxRevocations {
+		violations = append(violations, fmt.Sprintf("%d revocations planned, the limit per run is %d", len(revocations), safeguards.MaxRevocations))
+	}
+	return violations
+}
+
+// enforceSafeguards stops the run before the first write if the revocations break any safeguard. Dry
+// runs only print the violations.
+func enforceSafeguards(config *Config, revocations []Revocation, dryRun bool) {
+	violations := checkSafeguards(config.Safeguards, revocations)
+	if len(violations) == 0 {
+		return
+	}
+	for _, violation := range violations {
+		log.Printf("- ERROR: %s", violation)
+	}
+	if dryRun {
+		log.Printf("- WARNING: the plan breaks %d safeguard(s) in config.json, a real run would abort", len(violations))
+		return
+	}
+	log.Fatalf("aborted before the first write: the plan breaks %d safeguard(s) in config.json", len(violations))
+}
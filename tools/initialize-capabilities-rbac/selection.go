@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Capability selection
+
+Every command works on the capabilities GET /capabilities returns (the endpoint is not paged, one
+response holds them all), narrowed down by these flags:
+
+	--ids <list>            comma-separated capability IDs or globs, e.g. "cap-a,payments-*"
+	--status <list>         statuses to process, e.g. "Active,Pending Deletion" (default all but Deleted)
+	--metadata key=value    metadata predicate, repeatable; value * only requires the key to be set
+	--created-after <date>  only capabilities created after this date (2006-01-02)
+
+After an incident a handful of capabilities can be re-bootstrapped with --ids instead of all of them.
+*/
+
+type CapabilityFilter struct {
+	IDs          []string               `json:"ids,omitempty"`
+	Statuses     []string               `json:"statuses,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAfter time.Time              `json:"createdAfter"`
+}
+
+type metadataFlag map[string]interface{}
+
+func (m metadataFlag) String() string {
+	return fmt.Sprint(map[string]interface{}(m))
+}
+
+func (m metadataFlag) Set(value string) error {
+	key, expected, found := strings.Cut(value, "=")
+	if !found || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value, got '%s'", value)
+	}
+	m[strings.TrimSpace(key)] = strings.TrimSpace(expected)
+	return nil
+}
+
+// addFilterFlags registers the selection flags on a command and returns a function that reads them
+// after parsing.
+func addFilterFlags(flags *flag.FlagSet) func() (CapabilityFilter, error) {
+	ids := flags.String("ids", "", "comma-separated capability IDs or globs")
+	statuses := flags.String("status", "", "comma-separated statuses to process (default all but Deleted)")
+	metadata := metadataFlag{}
+	flags.Var(metadata, "metadata", "metadata predicate key=value, repeatable")
+	createdAfter := flags.String("created-after", "", "only capabilities created after this date (2006-01-02)")
+
+	return func() (CapabilityFilter, error) {
+		filter := CapabilityFilter{IDs: splitList(*ids), Statuses: splitList(*statuses), Metadata: metadata}
+		for _, pattern := range filter.IDs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return filter, fmt.Errorf("invalid --ids pattern '%s': %w", pattern, err)
+			}
+		}
+		if *createdAfter != "" {
+			date, err := time.Parse("2006-01-02", *createdAfter)
+			if err != nil {
+				return filter, fmt.Errorf("--created-after '%s' is not a date like 2006-01-02", *createdAfter)
+			}
+			filter.CreatedAfter = date
+		}
+		return filter, nil
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// statusKey compares statuses regardless of case, spaces and dashes, so pending-deletion matches
+// "Pending Deletion".
+func statusKey(status string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(status))
+}
+
+// matches reports whether a capability is selected, or why not.
+func (f CapabilityFilter) matches(c Capability) (bool, string) {
+	if len(f.IDs) > 0 {
+		selected := false
+		for _, pattern := range f.IDs {
+			if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(c.ID)); matched {
+				selected = true
+			}
+		}
+		if !selected {
+			return false, "not in --ids"
+		}
+	}
+
+	if len(f.Statuses) == 0 {
+		if statusKey(c.Status) == "deleted" {
+			return false, "deleted"
+		}
+	} else {
+		selected := false
+		for _, status := range f.Statuses {
+			selected = selected || statusKey(status) == statusKey(c.Status)
+		}
+		if !selected {
+			return false, fmt.Sprintf("status %s", c.Status)
+		}
+	}
+
+	if !f.CreatedAfter.IsZero() && !c.CreatedAt.After(f.CreatedAfter) {
+		return false, "created before --created-after"
+	}
+
+	if len(f.Metadata) > 0 {
+		metadata, err := parseMetadata(c)
+		if err != nil || !metadataMatches(f.Metadata, metadata) {
+			return false, "metadata does not match"
+		}
+	}
+
+	return true, ""
+}
+
+// selectCapabilities applies a filter and counts the capabilities left out per reason.
+func selectCapabilities(capabilities []Capability, filter CapabilityFilter) ([]Capability, map[string]int) {
+	var selected []Capability
+	skipped := map[string]int{}
+	for _, c := range capabilities {
+		if ok, reason := filter.matches(c); ok {
+			selected = append(selected, c)
+		} else {
+			skipped[reason]++
+		}
+	}
+	return selected, skipped
+}
+
+// fetchSelectedCapabilities fetches all capabilities and applies the filter, printing what was left out.
+func fetchSelectedCapabilities(config *Config, filter CapabilityFilter) ([]Capability, int, error) {
+	capabilities, err := fetchCapabilities(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	selected, skipped := selectCapabilities(capabilities, filter)
+	reasons := make([]string, 0, len(skipped))
+	for reason := range skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	total := 0
+	for _, reason := range reasons {
+		fmt.Printf("Skipping %d capabilities: %s\n", skipped[reason], reason)
+		total += skipped[reason]
+	}
+	return selected, total, nil
+}
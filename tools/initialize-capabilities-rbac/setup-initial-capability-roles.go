@@ -3,25 +3,26 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-)
-
-const (
-	apiBaseURL = "http://localhost:8080" // replace with real API base
+	"time"
 )
 
 type Capability struct {
-	ID           string `json:"id"`
-	Status       string `json:"status"`
-	JsonMetadata string `json:"jsonMetadata"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Status       string    `json:"status"`
+	JsonMetadata string    `json:"jsonMetadata"`
+	CreatedAt    time.Time `json:"createdAt"`
 }
 
 type RoleAssignment struct {
+	ID                 string `json:"id,omitempty"`
 	RoleId             string `json:"roleId"`
 	AssignedEntityType string `json:"assignedEntityType"`
 	AssignedEntityId   string `json:"assignedEntityId"`
@@ -41,18 +42,23 @@ type Member struct {
 }
 
 func main() {
+	command := "backfill"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
 	// Load config
 	config, err := loadConfig("config.json")
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	accessToken := config.AccessToken
-	if accessToken == "" {
+	if config.AccessToken == "" {
 		log.Fatal("access token is required")
 	}
 
-	availableRoles, err := fetchRoles(accessToken)
+	availableRoles, err := fetchRoles(config)
 	if err != nil {
 		log.Fatalf("failed to fetch roles: %v", err)
 	}
@@ -64,67 +70,400 @@ func main() {
 		}
 	}
 
-	capabilities, err := fetchCapabilities(accessToken)
+	switch command {
+	case "backfill":
+		runBackfill(config, availableRoles, args)
+	case "orphans":
+		runOrphans(config, availableRoles, args)
+	case "consistency":
+		runConsistency(config, availableRoles, args)
+	case "cleanup":
+		runCleanup(config, availableRoles, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: go run *.go [command] [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  backfill         grant capability roles from membership and metadata role rules (default)")
+	fmt.Fprintln(os.Stderr, "    --reconcile    keep only the owners named in metadata, demoting other owners")
+	fmt.Fprintln(os.Stderr, "    --dry-run      print the planned grants and revocations without changing anything")
+	fmt.Fprintln(os.Stderr, "    --checkpoint   file recording progress and failures (default backfill-checkpoint.json)")
+	fmt.Fprintln(os.Stderr, "    --resume       skip capabilities the checkpoint records as processed, retrying failed ones")
+	fmt.Fprintln(os.Stderr, "    --restart      discard the checkpoint of an earlier run and start over")
+	fmt.Fprintln(os.Stderr, "  orphans          report capabilities without an Owner who is still a member")
+	fmt.Fprintln(os.Stderr, "    --promote      grant Owner to the member picked by the configured promotion rule")
+	fmt.Fprintln(os.Stderr, "    --dry-run      with --promote, only print who would be promoted")
+	fmt.Fprintln(os.Stderr, "  consistency      report members without a capability role and grants held by non-members")
+	fmt.Fprintln(os.Stderr, "    --fix          resolve them in the direction configured in config.json")
+	fmt.Fprintln(os.Stderr, "    --dry-run      with --fix, only print the fixes")
+	fmt.Fprintln(os.Stderr, "  cleanup          plan revoking capability grants on deleted and missing capabilities")
+	fmt.Fprintln(os.Stderr, "    --revoke       revoke the planned grants")
+	fmt.Fprintln(os.Stderr, "    --max          revoke nothing if more grants are planned (default 50, 0 for no limit)")
+	fmt.Fprintln(os.Stderr, "    --warn-pending also list capabilities pending deletion")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "backfill, orphans and consistency select capabilities with (see selection.go):")
+	fmt.Fprintln(os.Stderr, "  --ids <list>             comma-separated capability IDs or globs")
+	fmt.Fprintln(os.Stderr, "  --status <list>          statuses to process (default all but Deleted)")
+	fmt.Fprintln(os.Stderr, "  --metadata key=value     metadata predicate, repeatable")
+	fmt.Fprintln(os.Stderr, "  --created-after <date>   only capabilities created after this date (2006-01-02)")
+}
+
+func runBackfill(config *Config, availableRoles map[string]string, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	reconcile := flags.Bool("reconcile", false, "keep only the owners named in metadata, demoting other owners")
+	dryRun := flags.Bool("dry-run", false, "print the planned grants and revocations without changing anything")
+	checkpointPath := flags.String("checkpoint", defaultCheckpointPath, "file recording progress and failures")
+	resume := flags.Bool("resume", false, "skip capabilities the checkpoint records as processed, retrying failed ones")
+	restart := flags.Bool("restart", false, "discard the checkpoint of an earlier run and start over")
+	getFilter := addFilterFlags(flags)
+	flags.Parse(args)
+
+	filter, err := getFilter()
+	if err != nil {
+		log.Fatalf("invalid selection: %v", err)
+	}
+	if *resume && *dryRun {
+		log.Fatal("--resume cannot be combined with --dry-run, dry runs do not keep a checkpoint")
+	}
+	if *resume && *restart {
+		log.Fatal("--resume cannot be combined with --restart")
+	}
+	capabilities, skipped, err := fetchSelectedCapabilities(config, filter)
 	if err != nil {
 		log.Fatalf("failed to fetch capabilities: %v", err)
 	}
 
+	rules, err := loadRoleRules(config.RoleRulesPath, availableRoles)
+	if err != nil {
+		log.Fatalf("failed to load role rules: %v", err)
+	}
+
+	if err := config.Owners.validate(); err != nil {
+		log.Fatalf("invalid owners configuration: %v", err)
+	}
+
+	options := BackfillOptions{
+		Reconcile: *reconcile,
+		DryRun:    *dryRun,
+		Rules:     rules,
+		Owners:    config.Owners,
+		Resolver:  newPrincipalResolver(config, *dryRun),
+	}
+	mode := "backfill"
+	if *reconcile {
+		mode = "reconcile"
+	}
+	checkpoint := newCheckpoint(*checkpointPath, mode, filter)
+	switch {
+	case *dryRun:
+	case *resume:
+		if checkpoint, err = loadCheckpoint(*checkpointPath, mode, filter); err != nil {
+			log.Fatalf("failed to load checkpoint: %v", err)
+		}
+		fmt.Printf("Resuming from %s: %d capabilities processed, %d failed\n", *checkpointPath, len(checkpoint.Completed), len(checkpoint.Failed))
+	case !*restart:
+		exists, err := checkpointExists(*checkpointPath)
+		if err != nil {
+			log.Fatalf("failed to read checkpoint: %v", err)
+		}
+		if exists {
+			log.Fatalf("%s holds the progress of an earlier run; continue it with --resume or discard it with --restart", *checkpointPath)
+		}
+	}
+
+	summary := &BackfillSummary{DryRun: *dryRun, Skipped: skipped}
+	var plans []CapabilityPlan
 	for _, c := range capabilities {
+		if checkpoint.isCompleted(c.ID) {
+			summary.Resumed++
+			continue
+		}
 		fmt.Printf("Processing capability: %s\n", c.ID)
+		summary.Scanned++
+		plans = append(plans, planBackfill(config, c, availableRoles, options, summary))
+	}
 
-		// check for deleted using Status in lower case
-		if strings.ToLower(c.Status) == "deleted" {
-			continue
+	var revocations []Revocation
+	for _, plan := range plans {
+		for _, change := range plan.Changes {
+			if change.Action == "revoke" {
+				revocations = append(revocations, Revocation{Principal: change.UserId, Description: change.String()})
+			}
 		}
+	}
+	enforceSafeguards(config, revocations, *dryRun)
 
-		// Fetch members for the capability
-		members, err := fetchMembers(accessToken, c.ID)
-		if err != nil {
-			log.Printf("failed to fetch members for capability %s: %v", c.ID, err)
+	for _, plan := range plans {
+		errs := applyBackfill(config, plan, availableRoles, options, summary)
+		if *dryRun {
 			continue
 		}
+		if err := checkpoint.record(plan.Capability.ID, errs); err != nil {
+			log.Fatalf("failed to save checkpoint %s: %v", *checkpointPath, err)
+		}
+	}
 
-		// Metadata is a json string, parse to find dfds.owner
-		var metadata map[string]interface{}
-		if err := json.Unmarshal([]byte(c.JsonMetadata), &metadata); err != nil {
-			log.Printf("failed to parse metadata for capability %s: %v", c.ID, err)
+	summary.Print()
+	if !*dryRun {
+		if err := checkpoint.finish(); err != nil {
+			log.Fatalf("failed to remove checkpoint %s: %v", *checkpointPath, err)
+		}
+	}
+	checkpoint.printRetryList()
+	if summary.Failures > 0 {
+		os.Exit(1)
+	}
+}
+
+/*
+Backfill
+
+Each run compares the grants a capability should have, as decided by the role rules (see rules.go),
+with the ones GET /rbac/role/capability/{id} returns and only creates the missing (user, role, capability) tuples, so the initializer can be re-run
+safely. Every selected capability is planned before the first change is made, so the revocations can be
+checked against the safeguards (see safeguards.go). Errors are counted and reported instead of stopping
+the run, and progress is kept in a checkpoint so an interrupted run can continue with --resume (see
+checkpoint.go).
+
+With --reconcile, the metadata is authoritative: anyone the rules do not make Owner (dfds.owner with the
+built-in rule) is demoted. A demoted member first gets their rule's role and then loses Owner, in that
+order, because the API removes the capability membership when a user's last capability role is revoked.
+Run with --dry-run to review the plan first. Capabilities whose metadata names no owner are not
+reconciled, as nobody is named to keep Owner.
+*/
+
+type BackfillOptions struct {
+	Reconcile bool
+	DryRun    bool
+	Rules     []RoleRule
+	Owners    OwnerPolicy
+	Resolver  *PrincipalResolver
+}
+
+type BackfillSummary struct {
+	DryRun   bool
+	Scanned  int // capabilities looked at
+	Skipped  int // left out by status or selection filters
+	Resumed  int // already processed according to the checkpoint
+	Present  int // grants that already existed
+	Created  int
+	Revoked  int // Owner grants revoked by --reconcile
+	Failures int
+}
+
+func (s *BackfillSummary) Print() {
+	fmt.Println("")
+	if s.DryRun {
+		fmt.Println("Summary (dry run, nothing was changed):")
+	} else {
+		fmt.Println("Summary:")
+	}
+	fmt.Printf("  capabilities scanned:    %d (%d skipped)\n", s.Scanned, s.Skipped)
+	if s.Resumed > 0 {
+		fmt.Printf("  already processed:       %d\n", s.Resumed)
+	}
+	fmt.Printf("  grants already present:  %d\n", s.Present)
+	fmt.Printf("  grants created:          %d\n", s.Created)
+	fmt.Printf("  grants revoked:          %d\n", s.Revoked)
+	fmt.Printf("  failures:                %d\n", s.Failures)
+}
+
+// DesiredGrant is a capability role a user should hold.
+type DesiredGrant struct {
+	UserId   string
+	RoleName string // lower case, as keyed in availableRoles
+}
+
+// CapabilityChange is one grant or revocation the backfill makes on a capability.
+type CapabilityChange struct {
+	Action       string // grant or revoke
+	CapabilityId string
+	UserId       string
+	RoleName     string
+	GrantId      string // grant to revoke
+	Reason       string
+}
+
+func (c CapabilityChange) String() string {
+	if c.Action == "revoke" {
+		return fmt.Sprintf("revoke %s on %s from %s (grant %s, %s)", c.RoleName, c.CapabilityId, c.UserId, c.GrantId, c.Reason)
+	}
+	return fmt.Sprintf("grant %s on %s to %s", c.RoleName, c.CapabilityId, c.UserId)
+}
+
+func isDesired(desired []DesiredGrant, userId, roleName string) bool {
+	for _, grant := range desired {
+		if memberKey(grant.UserId) == memberKey(userId) && grant.RoleName == roleName {
+			return true
+		}
+	}
+	return false
+}
+
+func grantKey(userId, roleId string) string {
+	return strings.ToLower(strings.TrimSpace(userId)) + "|" + strings.ToLower(roleId)
+}
+
+// planCapability returns the changes that bring a capability's grants in line with desiredGrants. Grants
+// come before revocations, see the note on --reconcile above.
+func planCapability(c Capability, members []Member, existing []RoleAssignment, availableRoles map[string]string,
+	options BackfillOptions) ([]CapabilityChange, int, error) {
+	desired, owners, decisions, err := desiredGrants(c, members, options.Rules, options.Owners, options.Resolver)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, decision := range decisions {
+		fmt.Printf("  %s\n", decision)
+	}
+
+	granted := make(map[string]bool, len(existing))
+	for _, grant := range existing {
+		if strings.EqualFold(grant.AssignedEntityType, "User") {
+			granted[grantKey(grant.AssignedEntityId, grant.RoleId)] = true
+		}
+	}
+
+	var changes []CapabilityChange
+	present := 0
+	for _, grant := range desired {
+		key := grantKey(grant.UserId, availableRoles[grant.RoleName])
+		if granted[key] {
+			present++
 			continue
 		}
+		granted[key] = true
+		changes = append(changes, CapabilityChange{Action: "grant", CapabilityId: c.ID, UserId: grant.UserId, RoleName: grant.RoleName})
+	}
 
-		// Check if dfds.owner exists and is non-empty
-		// if so, set their role to Owner
-		ownerEmail, hasOwner := metadata["dfds.owner"].(string)
-		if hasOwner && ownerEmail != "" {
-			// Grant Contributor to all members
-			for _, m := range members {
-				err := assignRole(accessToken, c.ID, m.Id, "contributor", availableRoles)
-				if err != nil {
-					panic(err)
-				}
+	if options.Reconcile && len(owners) > 0 {
+		for _, grant := range existing {
+			if !strings.EqualFold(grant.AssignedEntityType, "User") || !strings.EqualFold(grant.RoleId, availableRoles["owner"]) {
+				continue
 			}
-
-			// Grant Owner to specified owner
-			err = assignRole(accessToken, c.ID, ownerEmail, "owner", availableRoles)
-			if err != nil {
-				panic(err)
+			if isDesired(desired, grant.AssignedEntityId, "owner") {
+				continue
 			}
+			changes = append(changes, CapabilityChange{
+				Action:       "revoke",
+				CapabilityId: c.ID,
+				UserId:       grant.AssignedEntityId,
+				RoleName:     "owner",
+				GrantId:      grant.ID,
+				Reason:       fmt.Sprintf("owners are %s", strings.Join(owners, ", ")),
+			})
+		}
+	}
+
+	return changes, present, nil
+}
+
+// CapabilityPlan holds the changes the backfill is about to make on one capability.
+type CapabilityPlan struct {
+	Capability Capability
+	Changes    []CapabilityChange
+	Errors     []string // met while planning; nothing is changed on the capability then
+}
+
+// planBackfill fetches a capability's members and grants and plans its changes.
+func planBackfill(config *Config, c Capability, availableRoles map[string]string, options BackfillOptions, summary *BackfillSummary) CapabilityPlan {
+	plan := CapabilityPlan{Capability: c}
+	fail := func(format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		log.Print(message)
+		plan.Errors = append(plan.Errors, message)
+		summary.Failures++
+	}
+
+	// Fetch members for the capability
+	members, err := fetchMembers(config, c.ID)
+	if err != nil {
+		fail("failed to fetch members for capability %s: %v", c.ID, err)
+		return plan
+	}
+
+	existing, err := fetchCapabilityRoleGrants(config, c.ID)
+	if err != nil {
+		fail("failed to fetch role grants for capability %s: %v", c.ID, err)
+		return plan
+	}
+
+	changes, present, err := planCapability(c, members, existing, availableRoles, options)
+	if err != nil {
+		fail("capability %s: %v", c.ID, err)
+		return plan
+	}
+	summary.Present += present
+	plan.Changes = changes
+
+	return plan
+}
+
+// applyBackfill makes the planned changes on one capability and returns the errors met while planning and
+// applying, for the checkpoint. A capability without errors has been fully processed.
+func applyBackfill(config *Config, plan CapabilityPlan, availableRoles map[string]string, options BackfillOptions, summary *BackfillSummary) []string {
+	errs := append([]string{}, plan.Errors...)
+	fail := func(format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		log.Print(message)
+		errs = append(errs, message)
+		summary.Failures++
+	}
+
+	if len(plan.Changes) > 0 {
+		fmt.Printf("Changes for capability: %s\n", plan.Capability.ID)
+	}
+
+	// A demoted owner keeps Owner until their new role is granted, otherwise they lose the membership.
+	grantFailed := make(map[string]bool)
+	for _, change := range plan.Changes {
+		if options.DryRun {
+			fmt.Printf("  would %s\n", change)
 		} else {
-			// No specified owner, set all members to owner
-			for _, m := range members {
-				err := assignRole(accessToken, c.ID, m.Id, "owner", availableRoles)
-				if err != nil {
-					panic(err)
+			if change.Action == "revoke" && grantFailed[memberKey(change.UserId)] {
+				fail("skipped: %s, because granting %s their new role failed", change, change.UserId)
+				continue
+			}
+			var err error
+			if change.Action == "revoke" {
+				err = revokeRole(config, change.GrantId)
+			} else {
+				err = assignRole(config, change.CapabilityId, change.UserId, change.RoleName, availableRoles)
+			}
+			if err != nil {
+				if change.Action == "grant" {
+					grantFailed[memberKey(change.UserId)] = true
 				}
+				fail("failed to %s: %v", change, err)
+				continue
 			}
+			fmt.Printf("  %s\n", change)
+		}
+
+		if change.Action == "revoke" {
+			summary.Revoked++
+		} else {
+			summary.Created++
 		}
 	}
+
+	return errs
 }
 
 type Config struct {
-	Debug         bool     `json:"debug"`
-	ApiUrl        string   `json:"apiUrl"`
-	AccessToken   string   // not from config, set from env var 'SELF_SERVICE_API_TOKEN'
-	RequiredRoles []string `json:"requiredRoles"`
+	Debug         bool            `json:"debug"`
+	ApiUrl        string          `json:"apiUrl"`
+	AccessToken   string          // not from config, set from env var 'SELF_SERVICE_API_TOKEN'
+	RequiredRoles []string        `json:"requiredRoles"`
+	Orphans       OrphanPromotion `json:"orphans"`
+	Consistency   ConsistencyFix  `json:"consistency"`
+	Owners        OwnerPolicy     `json:"owners"`
+	RoleRulesPath string          `json:"roleRules"` // see rules.go; empty uses the built-in dfds.owner rule
+	Safeguards    Safeguards      `json:"safeguards"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -150,10 +489,10 @@ func loadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
-func fetchRoles(token string) (map[string]string, error) {
-	url := fmt.Sprintf("%s/rbac/get-assignable-roles", apiBaseURL)
+func fetchRoles(config *Config) (map[string]string, error) {
+	url := fmt.Sprintf("%s/rbac/get-assignable-roles", config.ApiUrl)
 	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -182,10 +521,10 @@ func fetchRoles(token string) (map[string]string, error) {
 	return availableRoles, nil
 }
 
-func fetchCapabilities(token string) ([]Capability, error) {
-	url := fmt.Sprintf("%s/capabilities", apiBaseURL)
+func fetchCapabilities(config *Config) ([]Capability, error) {
+	url := fmt.Sprintf("%s/capabilities", config.ApiUrl)
 	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -210,11 +549,11 @@ func fetchCapabilities(token string) ([]Capability, error) {
 	return result.Capabilities, nil
 }
 
-func fetchMembers(token, capabilityId string) ([]Member, error) {
-	url := fmt.Sprintf("%s/capabilities/%s/members", apiBaseURL, capabilityId)
+func fetchMembers(config *Config, capabilityId string) ([]Member, error) {
+	url := fmt.Sprintf("%s/capabilities/%s/members", config.ApiUrl, capabilityId)
 	req, _ := http.NewRequest("GET", url, nil)
 
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -239,8 +578,32 @@ func fetchMembers(token, capabilityId string) ([]Member, error) {
 	return result.Members, nil
 }
 
-func assignRole(token, capabilityId, email, role string, availableRoles map[string]string) error {
-	url := fmt.Sprintf("%s/rbac/role/grant", apiBaseURL)
+func fetchCapabilityRoleGrants(config *Config, capabilityId string) ([]RoleAssignment, error) {
+	url := fmt.Sprintf("%s/rbac/role/capability/%s", config.ApiUrl, capabilityId)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var grants []RoleAssignment
+	if err := json.NewDecoder(resp.Body).Decode(&grants); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+func assignRole(config *Config, capabilityId, email, role string, availableRoles map[string]string) error {
+	url := fmt.Sprintf("%s/rbac/role/grant", config.ApiUrl)
 
 	payload := RoleAssignment{
 		RoleId:             availableRoles[role],
@@ -252,7 +615,7 @@ func assignRole(token, capabilityId, email, role string, availableRoles map[stri
 	body, _ := json.Marshal(payload)
 
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -263,10 +626,31 @@ func assignRole(token, capabilityId, email, role string, availableRoles map[stri
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
 		b, _ := ioutil.ReadAll(resp.Body)
 		return fmt.Errorf("failed to assign role: %s, [error code %d]", string(b), resp.StatusCode)
 	}
 
 	return nil
 }
+
+func revokeRole(config *Config, grantId string) error {
+	url := fmt.Sprintf("%s/rbac/role/revoke/%s", config.ApiUrl, grantId)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to revoke role: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to revoke role: %s, [error code %d]", string(b), resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Audit journal
+
+Every mutating API call made by this tool is appended to a JSON lines file, one entry per call.
+Entries are never rewritten; a rollback appends its own entries with 'reverts' set to the run it undid.
+*/
+
+const defaultJournalPath = "rbac-journal.jsonl"
+
+type JournalEntry struct {
+	Timestamp  time.Time       `json:"timestamp"`
+	RunId      string          `json:"runId"`
+	Operator   string          `json:"operator"`
+	Action     string          `json:"action"`
+	Request    json.RawMessage `json:"request"`
+	ObjectType string          `json:"objectType"`
+	ObjectId   string          `json:"objectId"`
+	Reverts    string          `json:"reverts,omitempty"`
+	// ObjectId of the entry in the reverted run that this entry undid
+	RevertsObjectId string `json:"revertsObjectId,omitempty"`
+}
+
+type Journal struct {
+	file     *os.File
+	runId    string
+	operator string
+	reverts  string
+	// object of the entry currently being reverted
+	revertsObjectId string
+}
+
+// startRun assigns a run ID, resolves the operator, opens the journal and takes the run lock for the current command.
+func startRun(config *Config) {
+	config.RunId = newRunId()
+	config.Operator = fetchOperator(config)
+
+	path := config.JournalPath
+	if path == "" {
+		path = defaultJournalPath
+	}
+
+	journal, err := openJournal(path, config.RunId, config.Operator)
+	if err != nil {
+		fatalf("failed to open journal '%s': %v", path, err)
+	}
+	config.Journal = journal
+
+	log.Printf("Run ID: %s (operator: %s, journal: %s)", config.RunId, config.Operator, path)
+
+	acquireRunLock(config)
+}
+
+// finishRun releases the run lock and closes the journal opened by startRun. Only the first call does
+// anything, so a run may be finished both by fatalf and by a deferred call.
+func finishRun(config *Config) {
+	if activeRun == nil {
+		return
+	}
+	releaseRunLock(config)
+	config.Journal.Close()
+}
+
+func openJournal(path, runId, operator string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file, runId: runId, operator: operator}, nil
+}
+
+// Record appends an entry for a mutating call. It is a no-op on a nil journal.
+func (j *Journal) Record(action string, request interface{}, objectType, objectId string) {
+	if j == nil {
+		return
+	}
+
+	rawRequest, err := json.Marshal(request)
+	if err != nil {
+		fatalf("failed to encode journal request for '%s': %v", action, err)
+	}
+
+	entry := JournalEntry{
+		Timestamp:  time.Now().UTC(),
+		RunId:      j.runId,
+		Operator:   j.operator,
+		Action:     action,
+		Request:    rawRequest,
+		ObjectType: objectType,
+		ObjectId:   objectId,
+		Reverts:    j.reverts,
+
+		RevertsObjectId: j.revertsObjectId,
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		// A change we cannot journal is a change we cannot roll back, so stop here.
+		fatalf("failed to write journal entry for '%s': %v", action, err)
+	}
+}
+
+func (j *Journal) Close() {
+	if j == nil {
+		return
+	}
+	j.file.Close()
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func newRunId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(b))
+}
+
+/*
+Operator identity
+*/
+
+// fetchOperator resolves who is running the tool. /rbac/me only exposes the caller's ID through grants
+// assigned directly to the user, so the token claims are used when the caller's access is group-based.
+func fetchOperator(config *Config) string {
+	url := fmt.Sprintf("%s/rbac/me", config.ApiUrl)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to fetch operator identity: %v", err)
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			var me struct {
+				PermissionGrants []PermissionGrant `json:"permissionGrants"`
+				RoleGrants       []RoleAssignment  `json:"roleGrants"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&me); err == nil {
+				for _, grant := range me.RoleGrants {
+					if strings.EqualFold(grant.AssignedEntityType, "User") && grant.AssignedEntityId != "" {
+						return grant.AssignedEntityId
+					}
+				}
+				for _, grant := range me.PermissionGrants {
+					if strings.EqualFold(grant.AssignedEntityType, "User") && grant.AssignedEntityId != "" {
+						return grant.AssignedEntityId
+					}
+				}
+			}
+		} else {
+			log.Printf("failed to fetch operator identity, [error code %d]", resp.StatusCode)
+		}
+	}
+
+	if operator := operatorFromToken(config.AccessToken); operator != "" {
+		return operator
+	}
+	return "unknown"
+}
+
+// operatorFromToken reads the identity claims of a JWT without verifying it; the API has already done that.
+func operatorFromToken(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	for _, claim := range []string{"preferred_username", "upn", "unique_name", "oid", "appid"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+/*
+Resolving IDs of created grants
+*/
+
+var errGrantNotFound = errors.New("grant not found")
+
+func lookupRoleGrantId(config *Config, grant RoleAssignment) (string, error) {
+	var existing []RoleAssignment
+	var err error
+	if strings.EqualFold(grant.AssignedEntityType, "Group") {
+		existing, err = fetchRoleGrantsForGroup(config, grant.AssignedEntityId)
+	} else {
+		existing, err = fetchRoleGrantsForUser(config, grant.AssignedEntityId)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Take the last match: if an identical grant already existed, the new one is listed after it.
+	id := ""
+	for _, candidate := range existing {
+		if strings.EqualFold(candidate.RoleId, grant.RoleId) &&
+			strings.EqualFold(candidate.Type, grant.Type) &&
+			normalizeGrantResource(candidate.Type, candidate.Resource) == normalizeGrantResource(grant.Type, grant.Resource) {
+			id = candidate.ID
+		}
+	}
+	if id == "" {
+		return "", errGrantNotFound
+	}
+	return id, nil
+}
+
+func lookupPermissionGrantId(config *Config, grant PermissionGrantCreation) (string, error) {
+	existing, err := fetchPermissionGrants(config, grant.AssignedEntityType, grant.AssignedEntityId)
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, candidate := range existing {
+		if strings.EqualFold(candidate.Namespace, grant.Namespace) &&
+			strings.EqualFold(candidate.Permission, grant.Permission) &&
+			strings.EqualFold(candidate.Type, grant.Type) &&
+			strings.EqualFold(normalizeGrantResource(candidate.Type, candidate.Resource), normalizeGrantResource(grant.Type, grant.Resource)) {
+			id = candidate.ID
+		}
+	}
+	if id == "" {
+		return "", errGrantNotFound
+	}
+	return id, nil
+}
+
+// journalObjectRef identifies the object of an entry for rollback bookkeeping. A grant whose ID could not
+// be resolved when it was made is identified by the time it was journaled instead.
+func journalObjectRef(entry JournalEntry) string {
+	if entry.ObjectId != "" {
+		return entry.ObjectId
+	}
+	return "@" + entry.Timestamp.Format(time.RFC3339Nano)
+}
+
+/*
+Rollback
+*/
+
+// runRollback reverses every change journaled by a run, newest first. Changes that an earlier
+// (possibly interrupted) rollback of the same run already reversed are skipped, so it can be re-run.
+func runRollback(config *Config, runId string) {
+	path := config.JournalPath
+	if path == "" {
+		path = defaultJournalPath
+	}
+
+	entries, err := readJournal(path)
+	if err != nil {
+		fatalf("failed to read journal '%s': %v", path, err)
+	}
+
+	reverted := make(map[string]bool)
+	var changes []JournalEntry
+	for _, entry := range entries {
+		if entry.Reverts == runId {
+			reverted[entry.ObjectType+"|"+entry.RevertsObjectId] = true
+		}
+		if entry.RunId == runId && entry.Reverts == "" {
+			changes = append(changes, entry)
+		}
+	}
+	if len(changes) == 0 {
+		fatalf("no journaled changes found for run '%s' in '%s'", runId, path)
+	}
+
+	// The reversals take rights away like any other run, so they are held to the same safeguards.
+	roleNames, groupNames, err := fetchObjectNames(config)
+	if err != nil {
+		fatalf("failed to fetch roles and groups: %v", err)
+	}
+	plan := &Plan{}
+	for i := len(changes) - 1; i >= 0; i-- {
+		if !reverted[changes[i].ObjectType+"|"+journalObjectRef(changes[i])] {
+			if change := revertChange(changes[i], roleNames, groupNames); change.Action != "" {
+				plan.add(change)
+			}
+		}
+	}
+	enforceSafeguards(config, plan)
+
+	log.Printf(">> Rolling back %d change(s) from run %s...", len(changes), runId)
+	config.Journal.reverts = runId
+
+	undone, skipped := 0, 0
+	for i := len(changes) - 1; i >= 0; i-- {
+		entry := changes[i]
+		if reverted[entry.ObjectType+"|"+journalObjectRef(entry)] {
+			skipped++
+			continue
+		}
+		config.Journal.revertsObjectId = journalObjectRef(entry)
+		if err := revertEntry(config, entry); err != nil {
+			fatalf("rollback of run '%s' stopped at '%s' (%s %s): %v. Re-run the rollback once the cause is fixed.", runId, entry.Action, entry.ObjectType, entry.ObjectId, err)
+		}
+		undone++
+	}
+
+	log.Printf("<< Rollback of run %s completed: %d change(s) reversed, %d already reversed.", runId, undone, skipped)
+}
+
+// fetchObjectNames maps lowercase role and group IDs to their names.
+func fetchObjectNames(config *Config) (map[string]string, map[string]string, error) {
+	roles, err := fetchRoleList(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := fetchGroupList(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roleNames := make(map[string]string, len(roles))
+	for _, role := range roles {
+		roleNames[strings.ToLower(role.ID)] = role.Name
+	}
+	groupNames := make(map[string]string, len(groups))
+	for _, group := range groups {
+		groupNames[strings.ToLower(group.ID)] = group.Name
+	}
+	return roleNames, groupNames, nil
+}
+
+// revertChange describes what revertEntry will do for a journal entry as a plan change, naming the roles
+// and groups involved so the safeguards can be checked. Objects that no longer exist are named by ID.
+// Entries revertEntry cannot reverse give a change without an action.
+func revertChange(entry JournalEntry, roleNames, groupNames map[string]string) Change {
+	var request struct {
+		Name               string `json:"name"`
+		RoleId             string `json:"roleId"`
+		UserId             string `json:"userId"`
+		GroupId            string `json:"groupId"`
+		Namespace          string `json:"namespace"`
+		Permission         string `json:"permission"`
+		AssignedEntityType string `json:"assignedEntityType"`
+		AssignedEntityId   string `json:"assignedEntityId"`
+		Type               string `json:"type"`
+		Resource           string `json:"resource"`
+	}
+	json.Unmarshal(entry.Request, &request)
+
+	nameOf := func(names map[string]string, id string) string {
+		if name, found := names[strings.ToLower(id)]; found {
+			return name
+		}
+		return id
+	}
+
+	change := Change{Namespace: request.Namespace, Permission: request.Permission, Type: request.Type, Resource: request.Resource, ObjectId: entry.ObjectId}
+	if request.RoleId != "" {
+		change.RoleName = nameOf(roleNames, request.RoleId)
+	}
+	switch strings.ToLower(request.AssignedEntityType) {
+	case "group":
+		change.GroupName = nameOf(groupNames, request.AssignedEntityId)
+	case "role":
+		change.RoleName = nameOf(roleNames, request.AssignedEntityId)
+	case "user":
+		change.User = request.AssignedEntityId
+	}
+
+	switch entry.Action {
+	case "create-role":
+		change.Action, change.RoleName = "delete-role", request.Name
+	case "create-group":
+		change.Action, change.GroupName = "delete-group", request.Name
+	case "add-member", "remove-member":
+		change.Action, change.Member, change.GroupName = "remove-member", request.UserId, nameOf(groupNames, request.GroupId)
+		if entry.Action == "remove-member" {
+			change.Action = "add-member"
+		}
+	case "grant-role":
+		change.Action = "revoke-role"
+	case "grant-permission":
+		change.Action = "revoke-permission"
+	case "revoke-role":
+		change.Action = "grant-role"
+	case "revoke-permission":
+		change.Action = "grant-permission"
+	}
+	return change
+}
+
+// lookupJournaledGrant finds a grant whose ID was not resolved when it was journaled from the grant
+// request, so it can still be reverted.
+func lookupJournaledGrant(config *Config, entry JournalEntry) (string, error) {
+	switch entry.Action {
+	case "grant-role":
+		var grant RoleAssignment
+		if err := json.Unmarshal(entry.Request, &grant); err != nil {
+			return "", err
+		}
+		return lookupRoleGrantId(config, grant)
+	case "grant-permission":
+		var grant PermissionGrantCreation
+		if err := json.Unmarshal(entry.Request, &grant); err != nil {
+			return "", err
+		}
+		return lookupPermissionGrantId(config, grant)
+	default:
+		return "", fmt.Errorf("journal entry has no object ID")
+	}
+}
+
+func revertEntry(config *Config, entry JournalEntry) error {
+	if entry.ObjectId == "" {
+		id, err := lookupJournaledGrant(config, entry)
+		if errors.Is(err, errGrantNotFound) {
+			log.Printf("- WARNING: the grant of '%s' %s no longer exists, nothing to reverse.", entry.Action, entry.Request)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry.ObjectId = id
+	}
+
+	switch entry.Action {
+	case "create-role":
+		return deleteRole(config, entry.ObjectId)
+	case "create-group":
+		return deleteGroup(config, entry.ObjectId)
+	case "grant-role":
+		return revokeRole(config, RoleAssignment{ID: entry.ObjectId})
+	case "grant-permission":
+		return revokePermission(config, PermissionGrant{ID: entry.ObjectId})
+	case "add-member", "remove-member":
+		var membership struct {
+			UserId  string `json:"userId"`
+			GroupId string `json:"groupId"`
+		}
+		if err := json.Unmarshal(entry.Request, &membership); err != nil {
+			return err
+		}
+		if entry.Action == "add-member" {
+			return removeMembership(config, membership.GroupId, membership.UserId)
+		}
+		return createMembership(config, membership.GroupId, membership.UserId)
+	case "revoke-role":
+		var grant RoleAssignment
+		if err := json.Unmarshal(entry.Request, &grant); err != nil {
+			return err
+		}
+		return assignRole(config, grant.RoleId, grant.AssignedEntityType, grant.AssignedEntityId, grant.Type, grant.Resource)
+	case "revoke-permission":
+		var grant PermissionGrant
+		if err := json.Unmarshal(entry.Request, &grant); err != nil {
+			return err
+		}
+		return grantScopedPermission(config, PermissionGrantCreation{
+			Namespace:          grant.Namespace,
+			Permission:         grant.Permission,
+			Type:               grant.Type,
+			Resource:           grant.Resource,
+			AssignedEntityType: grant.AssignedEntityType,
+			AssignedEntityId:   grant.AssignedEntityId,
+		})
+	case "delete-role", "delete-group":
+		// Deleted objects cannot be brought back under their old ID; restore from a snapshot instead.
+		log.Printf("- WARNING: cannot reverse '%s' of %s '%s' automatically. Please review manually.", entry.Action, entry.ObjectType, entry.ObjectId)
+		return nil
+	default:
+		return fmt.Errorf("unknown journal action '%s'", entry.Action)
+	}
+}
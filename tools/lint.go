@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+/*
+Policy lint
+
+Built-in rules checked against config.json before any API call, so separation-of-duties mistakes fail
+the pipeline instead of reaching an environment. Each rule's severity can be overridden in config.json:
+
+	"lintRules": { "group-binds-role": "error", "read-only-roles": "off" }
+
+Severities are "error", "warning" and "off". Errors stop lint with a non-zero exit and stop sync before
+it starts.
+*/
+
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+	lintOff     = "off"
+)
+
+type lintFinding struct {
+	Rule     string
+	Severity string
+	Message  string
+}
+
+type lintRule struct {
+	ID          string
+	Severity    string // default, overridable through config.LintRules
+	Description string
+	Check       func(config *Config) []string
+}
+
+var lintRules = []lintRule{
+	{
+		ID:          "system-admin-restricted",
+		Severity:    lintError,
+		Description: "only CloudEngineer may hold system-admin permissions",
+		Check:       checkSystemAdminRestricted,
+	},
+	{
+		ID:          "read-only-roles",
+		Severity:    lintError,
+		Description: "Guest and Reader must not hold create, update or delete permissions",
+		Check:       checkReadOnlyRoles,
+	},
+	{
+		ID:          "group-binds-role",
+		Severity:    lintWarning,
+		Description: "every managed group binds at least one role",
+		Check:       checkGroupBindsRole,
+	},
+	{
+		ID:          "undefined-role",
+		Severity:    lintError,
+		Description: "groups only bind roles defined in config.json",
+		Check:       checkUndefinedRole,
+	},
+	{
+		ID:          "empty-namespace",
+		Severity:    lintWarning,
+		Description: "no blank namespace names and no namespaces without permissions",
+		Check:       checkEmptyNamespace,
+	},
+	{
+		ID:          "rbac-delete-needs-read",
+		Severity:    lintError,
+		Description: "a role granting rbac/delete also grants rbac/read",
+		Check:       checkRbacDeleteNeedsRead,
+	},
+	{
+		ID:          "team-link-mapping",
+		Severity:    lintError,
+		Description: "every teamLinks mapping names a team, a group and a role defined in config.json",
+		Check:       checkTeamLinkMapping,
+	},
+	{
+		ID:          "team-link-protected-group",
+		Severity:    lintError,
+		Description: "teamLinks mappings do not target groups protected by safeguards",
+		Check:       checkTeamLinkProtectedGroup,
+	},
+}
+
+func checkSystemAdminRestricted(config *Config) []string {
+	var messages []string
+	for _, role := range config.Roles {
+		if strings.EqualFold(strings.TrimSpace(role.Name), "CloudEngineer") {
+			continue
+		}
+		if permissions := normalizePermissionMap(role.Permissions)["system-admin"]; len(permissions) > 0 {
+			messages = append(messages, fmt.Sprintf("role '%s' holds system-admin/%s", role.Name, strings.Join(permissions, ", system-admin/")))
+		}
+	}
+	return messages
+}
+
+func isWriteVerb(permission string) bool {
+	for _, verb := range []string{"create", "update", "delete"} {
+		if permission == verb || strings.HasPrefix(permission, verb+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkReadOnlyRoles(config *Config) []string {
+	var messages []string
+	for _, role := range config.Roles {
+		name := strings.ToLower(strings.TrimSpace(role.Name))
+		if name != "guest" && name != "reader" {
+			continue
+		}
+		permissions := normalizePermissionMap(role.Permissions)
+		for _, namespace := range sortedNamespaces(permissions) {
+			for _, permission := range permissions[namespace] {
+				if isWriteVerb(permission) {
+					messages = append(messages, fmt.Sprintf("role '%s' holds %s/%s", role.Name, namespace, permission))
+				}
+			}
+		}
+	}
+	return messages
+}
+
+func checkGroupBindsRole(config *Config) []string {
+	var messages []string
+	for _, group := range resolveManagedGroups(config) {
+		if len(group.Roles) == 0 {
+			messages = append(messages, fmt.Sprintf("group '%s' binds no role, its members get nothing from it", group.Name))
+		}
+	}
+	return messages
+}
+
+func checkUndefinedRole(config *Config) []string {
+	defined := map[string]bool{}
+	for _, role := range config.Roles {
+		defined[roleKey(role.Name)] = true
+	}
+
+	var messages []string
+	for _, group := range resolveManagedGroups(config) {
+		for _, binding := range group.Roles {
+			if !defined[roleKey(binding.RoleName)] {
+				messages = append(messages, fmt.Sprintf("group '%s' binds role '%s', which is not defined in config.json", group.Name, binding.RoleName))
+			}
+		}
+	}
+	return messages
+}
+
+func checkTeamLinkMapping(config *Config) []string {
+	defined := map[string]bool{}
+	for _, role := range config.Roles {
+		defined[roleKey(role.Name)] = true
+	}
+
+	var messages []string
+	for i, mapping := range config.TeamLinks {
+		switch {
+		case strings.TrimSpace(mapping.Team) == "" || strings.TrimSpace(mapping.Group) == "":
+			messages = append(messages, fmt.Sprintf("teamLinks mapping %d needs both a team and a group", i+1))
+		case !defined[roleKey(mapping.Role)]:
+			messages = append(messages, fmt.Sprintf("teamLinks maps team '%s' to role '%s', which is not defined in config.json", mapping.Team, mapping.Role))
+		}
+	}
+	return messages
+}
+
+// A team link revokes its grants whenever a link goes away, which a protected group must never see.
+func checkTeamLinkProtectedGroup(config *Config) []string {
+	var messages []string
+	for _, mapping := range config.TeamLinks {
+		if containsFold(config.Safeguards.ProtectedGroups, mapping.Group) {
+			messages = append(messages, fmt.Sprintf("teamLinks maps team '%s' to group '%s', which is protected by safeguards", mapping.Team, mapping.Group))
+		}
+	}
+	return messages
+}
+
+// checkEmptyNamespace works on the raw permission map: normalizePermissionMap would hide both problems.
+func checkEmptyNamespace(config *Config) []string {
+	var messages []string
+	for _, role := range config.Roles {
+		namespaces := make([]string, 0, len(role.Permissions))
+		for namespace := range role.Permissions {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+
+		for _, namespace := range namespaces {
+			if strings.TrimSpace(namespace) == "" {
+				messages = append(messages, fmt.Sprintf("role '%s' has a blank namespace name", role.Name))
+				continue
+			}
+			empty := true
+			for _, permission := range role.Permissions[namespace] {
+				empty = empty && strings.TrimSpace(permission) == ""
+			}
+			if empty {
+				messages = append(messages, fmt.Sprintf("role '%s' lists namespace '%s' without permissions", role.Name, namespace))
+			}
+		}
+	}
+	return messages
+}
+
+func checkRbacDeleteNeedsRead(config *Config) []string {
+	var messages []string
+	for _, role := range config.Roles {
+		permissions := normalizePermissionMap(role.Permissions)["rbac"]
+		hasDelete, hasRead := false, false
+		for _, permission := range permissions {
+			hasDelete = hasDelete || permission == "delete"
+			hasRead = hasRead || permission == "read"
+		}
+		if hasDelete && !hasRead {
+			messages = append(messages, fmt.Sprintf("role '%s' grants rbac/delete without rbac/read", role.Name))
+		}
+	}
+	return messages
+}
+
+func sortedNamespaces(permissions map[string][]string) []string {
+	namespaces := make([]string, 0, len(permissions))
+	for namespace := range permissions {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func lintSeverity(config *Config, rule lintRule) string {
+	if severity, overridden := config.LintRules[rule.ID]; overridden {
+		return strings.ToLower(strings.TrimSpace(severity))
+	}
+	return rule.Severity
+}
+
+func lintConfig(config *Config) ([]lintFinding, error) {
+	known := map[string]bool{}
+	for _, rule := range lintRules {
+		known[rule.ID] = true
+	}
+	for id, severity := range config.LintRules {
+		if !known[id] {
+			return nil, fmt.Errorf("lintRules: unknown rule '%s'", id)
+		}
+		switch strings.ToLower(strings.TrimSpace(severity)) {
+		case lintError, lintWarning, lintOff:
+		default:
+			return nil, fmt.Errorf("lintRules: rule '%s' has severity '%s', expected error, warning or off", id, severity)
+		}
+	}
+
+	var findings []lintFinding
+	for _, rule := range lintRules {
+		severity := lintSeverity(config, rule)
+		if severity == lintOff {
+			continue
+		}
+		for _, message := range rule.Check(config) {
+			findings = append(findings, lintFinding{Rule: rule.ID, Severity: severity, Message: message})
+		}
+	}
+	return findings, nil
+}
+
+/*
+Command
+*/
+
+// runLint logs every finding and returns false if any of them is an error.
+func runLint(config *Config) bool {
+	findings, err := lintConfig(config)
+	if err != nil {
+		log.Printf("- ERROR: %v", err)
+		return false
+	}
+
+	errors := 0
+	for _, finding := range findings {
+		if finding.Severity == lintError {
+			errors++
+			log.Printf("- ERROR: [%s] %s", finding.Rule, finding.Message)
+		} else {
+			log.Printf("- WARNING: [%s] %s", finding.Rule, finding.Message)
+		}
+	}
+
+	if errors > 0 {
+		log.Printf("Lint failed: %d error(s), %d warning(s).", errors, len(findings)-errors)
+		return false
+	}
+	if config.Debug || len(findings) > 0 {
+		log.Printf("Lint passed with %d warning(s).", len(findings))
+	}
+	return true
+}
+
+func printLintRules(config *Config) {
+	for _, rule := range lintRules {
+		fmt.Printf("%-24s %-8s %s\n", rule.ID, lintSeverity(config, rule), rule.Description)
+	}
+}
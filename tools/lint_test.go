@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []string // rule and severity of each finding
+		wantErr bool
+	}{
+		{
+			name: "a clean config has no findings",
+			config: `{
+				"roles": [{ "name": "Reader", "permissions": { "topics": ["read-public"] } }],
+				"groups": [{ "name": "Readers", "roles": [{ "roleName": "Reader" }] }]
+			}`,
+		},
+		{
+			name: "system-admin is reserved for CloudEngineer",
+			config: `{
+				"roles": [
+					{ "name": "CloudEngineer", "permissions": { "system-admin": ["manage-permission-matrix"] } },
+					{ "name": "Contributor", "permissions": { "System-Admin": ["manage-permission-matrix"] } }
+				],
+				"groups": [{ "name": "CloudEngineers", "roles": [{ "roleName": "CloudEngineer" }] }]
+			}`,
+			want: []string{"system-admin-restricted error"},
+		},
+		{
+			name: "readers cannot write",
+			config: `{
+				"roles": [{ "name": "reader", "permissions": { "topics": ["read-public", "create", "delete-private"] } }],
+				"groups": [{ "name": "Readers", "roles": [{ "roleName": "Reader" }] }]
+			}`,
+			want: []string{"read-only-roles error", "read-only-roles error"},
+		},
+		{
+			name: "groups bind defined roles",
+			config: `{
+				"roles": [{ "name": "Reader", "permissions": { "topics": ["read-public"] } }],
+				"groups": [{ "name": "Empty" }, { "name": "Typo", "roles": [{ "roleName": "Raeder" }] }]
+			}`,
+			want: []string{"group-binds-role warning", "undefined-role error"},
+		},
+		{
+			name: "rbac/delete needs rbac/read and namespaces need permissions",
+			config: `{
+				"roles": [{ "name": "Admin", "permissions": { "rbac": ["delete"], "topics": [] } }],
+				"groups": [{ "name": "Admins", "roles": [{ "roleName": "Admin" }] }]
+			}`,
+			want: []string{"empty-namespace warning", "rbac-delete-needs-read error"},
+		},
+		{
+			name: "team links need a team, a defined role and an unprotected group",
+			config: `{
+				"roles": [{ "name": "Reader", "permissions": { "topics": ["read-public"] } }],
+				"groups": [{ "name": "Readers", "roles": [{ "roleName": "Reader" }] }],
+				"safeguards": { "protectedGroups": ["CloudEngineers"] },
+				"teamLinks": [
+					{ "group": "Readers", "role": "Reader" },
+					{ "team": "Cloud", "group": "Readers", "role": "Writer" },
+					{ "team": "Cloud", "group": "cloudengineers", "role": "Reader" }
+				]
+			}`,
+			want: []string{"team-link-mapping error", "team-link-mapping error", "team-link-protected-group error"},
+		},
+		{
+			name: "severities can be overridden",
+			config: `{
+				"roles": [{ "name": "Reader", "permissions": { "topics": ["read-public"] } }],
+				"groups": [{ "name": "Empty" }, { "name": "Typo", "roles": [{ "roleName": "Raeder" }] }],
+				"lintRules": { "group-binds-role": "Error", "undefined-role": "off" }
+			}`,
+			want: []string{"group-binds-role error"},
+		},
+		{
+			name:    "unknown rules are refused",
+			config:  `{ "lintRules": { "no-such-rule": "error" } }`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown severities are refused",
+			config:  `{ "lintRules": { "group-binds-role": "fatal" } }`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config Config
+			if err := json.Unmarshal([]byte(test.config), &config); err != nil {
+				t.Fatalf("invalid test config: %v", err)
+			}
+
+			findings, err := lintConfig(&config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			var got []string
+			for _, finding := range findings {
+				got = append(got, finding.Rule+" "+finding.Severity)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findings:\n got %q\nwant %q\n%v", got, test.want, findings)
+			}
+		})
+	}
+}
+
+func TestLintShippedConfig(t *testing.T) {
+	config, err := loadConfigFile("config.json")
+	if err != nil {
+		t.Fatalf("failed to load config.json: %v", err)
+	}
+	findings, err := lintConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range findings {
+		if finding.Severity == lintError {
+			t.Errorf("config.json fails lint: [%s] %s", finding.Rule, finding.Message)
+		}
+	}
+}
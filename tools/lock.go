@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Run lock
+
+Writers take a lease before touching the API: a lock file in the working directory guards against
+overlapping runs on the same machine, and a reserved group in the API guards the environment itself.
+Both record who holds the lease and when it expires, so a crashed run blocks others for at most the TTL.
+While the run lasts the lease is renewed every third of the TTL, so long runs keep it.
+
+log.Fatalf exits without running deferred calls, so a deferred finishRun never releases the lease of a
+run that stops on an error. Fatal errors go through fatalf instead, which releases it first.
+*/
+
+const (
+	lockGroupName      = "__rbac-reconciler-lock"
+	defaultLockPath    = ".rbac-reconciler.lock"
+	defaultLockTtlMins = 30
+)
+
+type RunLock struct {
+	Holder     string    `json:"holder"`
+	RunId      string    `json:"runId"`
+	Host       string    `json:"host"`
+	ApiUrl     string    `json:"apiUrl"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+func (l RunLock) String() string {
+	return fmt.Sprintf("%s (run %s on %s) since %s, expires %s",
+		l.Holder, l.RunId, l.Host, l.AcquiredAt.Format(time.RFC3339), l.ExpiresAt.Format(time.RFC3339))
+}
+
+func (l RunLock) expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+func newRunLock(config *Config) RunLock {
+	ttl := config.LockTtlMinutes
+	if ttl <= 0 {
+		ttl = defaultLockTtlMins
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+
+	return RunLock{
+		Holder:     config.Operator,
+		RunId:      config.RunId,
+		Host:       host,
+		ApiUrl:     config.ApiUrl,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(time.Duration(ttl) * time.Minute),
+	}
+}
+
+// The run holding the lock, and the renewal of its lease; set by acquireRunLock, cleared by releaseRunLock.
+var (
+	activeRun    *Config
+	stopRenewal  chan struct{}
+	renewalsDone sync.WaitGroup
+)
+
+// fatalf is log.Fatalf that releases the run lock and closes the journal of a run in progress first.
+func fatalf(format string, v ...interface{}) {
+	if activeRun != nil {
+		finishRun(activeRun)
+	}
+	log.Fatalf(format, v...)
+}
+
+func lockPath(config *Config) string {
+	if config.LockPath != "" {
+		return config.LockPath
+	}
+	return defaultLockPath
+}
+
+// acquireRunLock takes the local and the environment lock, or stops the run naming the current holder.
+func acquireRunLock(config *Config) {
+	lock := newRunLock(config)
+
+	if err := acquireLocalLock(lockPath(config), lock); err != nil {
+		log.Fatalf("cannot start run: %v", err)
+	}
+	if err := acquireEnvironmentLock(config, lock); err != nil {
+		os.Remove(lockPath(config))
+		log.Fatalf("cannot start run: %v", err)
+	}
+
+	if config.Debug {
+		log.Printf("Run lock acquired until %s.", lock.ExpiresAt.Format(time.RFC3339))
+	}
+
+	activeRun = config
+	stopRenewal = make(chan struct{})
+	renewalsDone.Add(1)
+	go renewRunLock(config, lock, stopRenewal)
+}
+
+// renewRunLock extends the lease every third of the TTL until stop is closed. A failed renewal is only
+// logged: the lease is still valid until it expires, and the next renewal tries again.
+func renewRunLock(config *Config, lock RunLock, stop chan struct{}) {
+	defer renewalsDone.Done()
+	ttl := lock.ExpiresAt.Sub(lock.AcquiredAt)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		lock.ExpiresAt = time.Now().UTC().Add(ttl)
+		body, _ := json.MarshalIndent(lock, "", "    ")
+		if err := os.WriteFile(lockPath(config), body, 0644); err != nil {
+			log.Printf("- WARNING: failed to renew local lock '%s': %v", lockPath(config), err)
+		}
+		if err := renewEnvironmentLock(config, lock); err != nil {
+			log.Printf("- WARNING: failed to renew environment run lock: %v", err)
+		}
+		if config.Debug {
+			log.Printf("Run lock renewed until %s.", lock.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// releaseRunLock stops the lease renewal and releases both locks.
+func releaseRunLock(config *Config) {
+	activeRun = nil
+	close(stopRenewal)
+	renewalsDone.Wait()
+
+	if err := releaseEnvironmentLock(config, config.RunId); err != nil {
+		log.Printf("- WARNING: failed to release environment run lock: %v. It expires on its own, or run 'unlock'.", err)
+	}
+	if err := os.Remove(lockPath(config)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("- WARNING: failed to remove lock file '%s': %v", lockPath(config), err)
+	}
+}
+
+/*
+Local lock file
+*/
+
+func acquireLocalLock(path string, lock RunLock) error {
+	body, _ := json.MarshalIndent(lock, "", "    ")
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			defer file.Close()
+			_, err = file.Write(body)
+			return err
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		existing, err := readLocalLock(path)
+		if err != nil {
+			return fmt.Errorf("lock file '%s' exists but cannot be read (%v); remove it if no other run is active", path, err)
+		}
+		if !existing.expired() {
+			return fmt.Errorf("another run holds the local lock '%s': %s", path, existing)
+		}
+
+		log.Printf("- WARNING: taking over expired local lock held by %s.", existing)
+		os.Remove(path)
+	}
+
+	return fmt.Errorf("could not acquire local lock '%s'", path)
+}
+
+func readLocalLock(path string) (RunLock, error) {
+	var lock RunLock
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return lock, err
+	}
+	err = json.Unmarshal(file, &lock)
+	return lock, err
+}
+
+/*
+Environment lock, held as a reserved group whose description carries the lease
+*/
+
+// Lock groups are created and deleted without journaling: they are not RBAC changes and must never be
+// touched by a rollback.
+func withoutJournal(config *Config) *Config {
+	unjournaled := *config
+	unjournaled.Journal = nil
+	return &unjournaled
+}
+
+func fetchLockGroups(config *Config) ([]Group, error) {
+	groups, err := fetchGroupList(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockGroups []Group
+	for _, group := range groups {
+		if isLockGroup(group.Name) {
+			lockGroups = append(lockGroups, group)
+		}
+	}
+	return lockGroups, nil
+}
+
+func isLockGroup(name string) bool {
+	return strings.EqualFold(strings.TrimSpace(name), lockGroupName)
+}
+
+func parseLockGroup(group Group) (RunLock, bool) {
+	var lock RunLock
+	if err := json.Unmarshal([]byte(group.Description), &lock); err != nil {
+		return lock, false
+	}
+	return lock, true
+}
+
+func acquireEnvironmentLock(config *Config, lock RunLock) error {
+	unjournaled := withoutJournal(config)
+
+	existing, err := fetchLockGroups(config)
+	if err != nil {
+		return fmt.Errorf("failed to check environment lock: %w", err)
+	}
+	for _, group := range existing {
+		held, ok := parseLockGroup(group)
+		if ok && !held.expired() {
+			return fmt.Errorf("another run holds the lock for %s: %s", config.ApiUrl, held)
+		}
+		if ok {
+			log.Printf("- WARNING: taking over expired environment lock held by %s.", held)
+		} else {
+			log.Printf("- WARNING: removing unreadable environment lock group '%s'.", group.ID)
+		}
+		if err := deleteGroup(unjournaled, group.ID); err != nil {
+			return fmt.Errorf("failed to remove stale environment lock: %w", err)
+		}
+	}
+
+	description, _ := json.Marshal(lock)
+	createGroupWithDescription(unjournaled, lockGroupName, string(description))
+
+	// Two runs can pass the check above at the same time. If another live lock shows up next to ours,
+	// back off rather than guess who was first; the other run does the same or proceeds alone.
+	current, err := fetchLockGroups(config)
+	if err != nil {
+		releaseEnvironmentLock(config, lock.RunId)
+		return fmt.Errorf("failed to verify environment lock: %w", err)
+	}
+	for _, group := range current {
+		held, ok := parseLockGroup(group)
+		if ok && held.RunId != lock.RunId && !held.expired() {
+			releaseEnvironmentLock(config, lock.RunId)
+			return fmt.Errorf("another run acquired the lock for %s at the same time: %s", config.ApiUrl, held)
+		}
+	}
+
+	return nil
+}
+
+// renewEnvironmentLock replaces the lock group of the run with one carrying the extended lease. Groups
+// cannot be updated, so the new group is created before the old one is deleted: the run holds a live
+// lock group at all times, and other runs ignore the two sharing a run ID.
+func renewEnvironmentLock(config *Config, lock RunLock) error {
+	previous, err := fetchLockGroups(config)
+	if err != nil {
+		return err
+	}
+
+	description, _ := json.Marshal(lock)
+	renewedId, err := createLockGroup(config, string(description))
+	if err != nil {
+		return err
+	}
+
+	for _, group := range previous {
+		if held, ok := parseLockGroup(group); ok && held.RunId == lock.RunId && group.ID != renewedId {
+			if err := deleteGroup(withoutJournal(config), group.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createLockGroup is createGroupWithDescription returning its error instead of stopping the run, for
+// renewals made next to the run.
+func createLockGroup(config *Config, description string) (string, error) {
+	url := fmt.Sprintf("%s/rbac/groups", config.ApiUrl)
+	body, _ := json.Marshal(map[string]string{"name": lockGroupName, "description": description})
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to create lock group, [error code %d]", resp.StatusCode)
+	}
+
+	var created Group
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func releaseEnvironmentLock(config *Config, runId string) error {
+	groups, err := fetchLockGroups(config)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if held, ok := parseLockGroup(group); ok && held.RunId == runId {
+			if err := deleteGroup(withoutJournal(config), group.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runUnlock breaks both locks regardless of holder, for runs that crashed before releasing them.
+func runUnlock(config *Config) {
+	if lock, err := readLocalLock(lockPath(config)); err == nil {
+		log.Printf("Removing local lock held by %s.", lock)
+		os.Remove(lockPath(config))
+	}
+
+	groups, err := fetchLockGroups(config)
+	if err != nil {
+		log.Fatalf("failed to fetch environment lock: %v", err)
+	}
+	for _, group := range groups {
+		if held, ok := parseLockGroup(group); ok {
+			log.Printf("Removing environment lock held by %s.", held)
+		}
+		if err := deleteGroup(withoutJournal(config), group.ID); err != nil {
+			log.Fatalf("failed to remove environment lock: %v", err)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Permission matrix
+
+A role x permission table for reviewers, built either from config.json or from the live
+GET /rbac/permission-matrix response. A cell is "inherited" when the role does not hold the permission
+itself but Guest does and the permission is capability scoped: the API hands Guest permissions to
+anyone without a capability role on the capability being checked.
+*/
+
+const (
+	cellGranted   = "granted"
+	cellInherited = "inherited"
+	cellMissing   = "missing"
+)
+
+type CataloguePermission struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	AccessType  string `json:"accessType"`
+}
+
+type PermissionMatrixGrant struct {
+	RoleId     string `json:"roleId"`
+	Namespace  string `json:"namespace"`
+	Permission string `json:"permission"`
+}
+
+// PermissionMatrixResponse mirrors GET /rbac/permission-matrix.
+type PermissionMatrixResponse struct {
+	Roles       []SystemRole            `json:"roles"`
+	Permissions []CataloguePermission   `json:"permissions"`
+	Grants      []PermissionMatrixGrant `json:"grants"`
+}
+
+type PermissionMatrix struct {
+	Source      string
+	Roles       []string
+	Permissions []CataloguePermission
+	granted     map[string]map[string]bool // role name -> permission key
+}
+
+func fetchPermissionMatrix(config *Config) (*PermissionMatrixResponse, error) {
+	url := fmt.Sprintf("%s/rbac/permission-matrix", config.ApiUrl)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to fetch permission matrix: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("unexpected status %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var matrix PermissionMatrixResponse
+	if err := json.NewDecoder(resp.Body).Decode(&matrix); err != nil {
+		log.Printf("failed to decode permission matrix response: %v", err)
+		return nil, err
+	}
+
+	return &matrix, nil
+}
+
+func matrixKey(namespace, permission string) string {
+	return strings.ToLower(strings.TrimSpace(namespace)) + "|" + strings.ToLower(strings.TrimSpace(permission))
+}
+
+func newPermissionMatrix(source string) *PermissionMatrix {
+	return &PermissionMatrix{Source: source, granted: map[string]map[string]bool{}}
+}
+
+func (m *PermissionMatrix) addRole(name string) {
+	if _, exists := m.granted[name]; !exists {
+		m.granted[name] = map[string]bool{}
+		m.Roles = append(m.Roles, name)
+	}
+}
+
+func (m *PermissionMatrix) grant(roleName, namespace, permission string) {
+	m.addRole(roleName)
+	m.granted[roleName][matrixKey(namespace, permission)] = true
+}
+
+// addPermissions adds catalogue rows, keeping the first description seen for each permission.
+func (m *PermissionMatrix) addPermissions(permissions []CataloguePermission) {
+	known := make(map[string]bool, len(m.Permissions))
+	for _, permission := range m.Permissions {
+		known[matrixKey(permission.Namespace, permission.Name)] = true
+	}
+	for _, permission := range permissions {
+		key := matrixKey(permission.Namespace, permission.Name)
+		if !known[key] {
+			known[key] = true
+			m.Permissions = append(m.Permissions, permission)
+		}
+	}
+}
+
+func (m *PermissionMatrix) sort() {
+	sort.SliceStable(m.Permissions, func(i, j int) bool {
+		a, b := m.Permissions[i], m.Permissions[j]
+		if !strings.EqualFold(a.Namespace, b.Namespace) {
+			return strings.ToLower(a.Namespace) < strings.ToLower(b.Namespace)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+func (m *PermissionMatrix) Cell(roleName string, permission CataloguePermission) string {
+	key := matrixKey(permission.Namespace, permission.Name)
+	if m.granted[roleName][key] {
+		return cellGranted
+	}
+	if shouldSkipRole(roleName) || !strings.EqualFold(permission.AccessType, "Capability") {
+		return cellMissing
+	}
+	for _, name := range m.Roles {
+		if shouldSkipRole(name) && m.granted[name][key] {
+			return cellInherited
+		}
+	}
+	return cellMissing
+}
+
+func matrixFromConfig(config *Config, catalogue []CataloguePermission) *PermissionMatrix {
+	matrix := newPermissionMatrix("config.json")
+	matrix.addPermissions(catalogue)
+
+	var fromConfig []CataloguePermission
+	for _, role := range config.Roles {
+		matrix.addRole(role.Name)
+		for namespace, permissions := range normalizePermissionMap(role.Permissions) {
+			for _, permission := range permissions {
+				matrix.grant(role.Name, namespace, permission)
+				fromConfig = append(fromConfig, CataloguePermission{Namespace: namespace, Name: permission})
+			}
+		}
+	}
+	// Permissions missing from the catalogue (or all of them, offline) still get a row.
+	matrix.addPermissions(fromConfig)
+
+	matrix.sort()
+	return matrix
+}
+
+func matrixFromLive(config *Config, response *PermissionMatrixResponse) *PermissionMatrix {
+	matrix := newPermissionMatrix(config.ApiUrl)
+	matrix.addPermissions(response.Permissions)
+
+	roleNames := make(map[string]string, len(response.Roles))
+	for _, role := range response.Roles {
+		roleNames[strings.ToLower(role.ID)] = role.Name
+		matrix.addRole(role.Name)
+	}
+
+	var ungranted []CataloguePermission
+	for _, grant := range response.Grants {
+		roleName, known := roleNames[strings.ToLower(grant.RoleId)]
+		if !known {
+			roleName = grant.RoleId
+		}
+		matrix.grant(roleName, grant.Namespace, grant.Permission)
+		ungranted = append(ungranted, CataloguePermission{Namespace: grant.Namespace, Name: grant.Permission})
+	}
+	matrix.addPermissions(ungranted)
+
+	matrix.sort()
+	return matrix
+}
+
+/*
+Output formats
+*/
+
+var markdownCells = map[string]string{
+	cellGranted:   "✅",
+	cellInherited: "↩️",
+	cellMissing:   "—",
+}
+
+func markdownEscape(value string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(value)
+}
+
+func writeMatrixMarkdown(w io.Writer, matrix *PermissionMatrix) error {
+	fmt.Fprintf(w, "### Permission matrix (%s)\n\n", matrix.Source)
+	fmt.Fprintf(w, "✅ granted, ↩️ inherited from Guest on capabilities the user has no role on, — missing.\n\n")
+
+	fmt.Fprint(w, "| Namespace | Permission | Description |")
+	for _, role := range matrix.Roles {
+		fmt.Fprintf(w, " %s |", markdownEscape(role))
+	}
+	fmt.Fprint(w, "\n|---|---|---|")
+	for range matrix.Roles {
+		fmt.Fprint(w, ":-:|")
+	}
+	fmt.Fprintln(w)
+
+	for _, permission := range matrix.Permissions {
+		fmt.Fprintf(w, "| %s | %s | %s |", markdownEscape(permission.Namespace), markdownEscape(permission.Name), markdownEscape(permission.Description))
+		for _, role := range matrix.Roles {
+			fmt.Fprintf(w, " %s |", markdownCells[matrix.Cell(role, permission)])
+		}
+		_, err := fmt.Fprintln(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMatrixCSV(w io.Writer, matrix *PermissionMatrix) error {
+	out := csv.NewWriter(w)
+	out.Write(append([]string{"namespace", "permission", "description"}, matrix.Roles...))
+	for _, permission := range matrix.Permissions {
+		row := []string{permission.Namespace, permission.Name, permission.Description}
+		for _, role := range matrix.Roles {
+			row = append(row, matrix.Cell(role, permission))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+var matrixTemplate = template.Must(template.New("matrix").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Permission matrix ({{.Matrix.Source}})</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+th { background: #f3f3f3; position: sticky; top: 0; }
+td.granted { background: #c8e6c9; text-align: center; }
+td.inherited { background: #fff3c4; text-align: center; }
+td.missing { color: #bbb; text-align: center; }
+tr:hover td { outline: 1px solid #999; }
+</style>
+</head>
+<body>
+<h1>Permission matrix</h1>
+<p>Source: {{.Matrix.Source}}. Inherited cells come from the Guest role on capabilities the user has no role on.</p>
+<table>
+<thead><tr><th>Namespace</th><th>Permission</th><th>Description</th>{{range .Matrix.Roles}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr><td>{{.Permission.Namespace}}</td><td>{{.Permission.Name}}</td><td>{{.Permission.Description}}</td>{{range .Cells}}<td class="{{.}}">{{.}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+func writeMatrixHTML(w io.Writer, matrix *PermissionMatrix) error {
+	type row struct {
+		Permission CataloguePermission
+		Cells      []string
+	}
+
+	rows := make([]row, 0, len(matrix.Permissions))
+	for _, permission := range matrix.Permissions {
+		r := row{Permission: permission}
+		for _, role := range matrix.Roles {
+			r.Cells = append(r.Cells, matrix.Cell(role, permission))
+		}
+		rows = append(rows, r)
+	}
+
+	return matrixTemplate.Execute(w, struct {
+		Matrix *PermissionMatrix
+		Rows   []row
+	}{matrix, rows})
+}
+
+/*
+Command
+*/
+
+func runMatrix(config *Config, args []string) {
+	flags := flag.NewFlagSet("matrix", flag.ExitOnError)
+	live := flags.Bool("live", false, "build the matrix from the live environment")
+	format := flags.String("format", "markdown", "markdown, csv or html")
+	outPath := flags.String("out", "", "output file (default stdout)")
+	flags.Parse(args)
+
+	writers := map[string]func(io.Writer, *PermissionMatrix) error{
+		"markdown": writeMatrixMarkdown,
+		"md":       writeMatrixMarkdown,
+		"csv":      writeMatrixCSV,
+		"html":     writeMatrixHTML,
+	}
+	write, known := writers[strings.ToLower(*format)]
+	if !known {
+		fatalf("unknown format '%s', expected markdown, csv or html", *format)
+	}
+
+	var matrix *PermissionMatrix
+	if *live {
+		if err := readAccessToken(config); err != nil {
+			fatalf("%v", err)
+		}
+		response, err := fetchPermissionMatrix(config)
+		if err != nil {
+			fatalf("failed to fetch permission matrix: %v", err)
+		}
+		matrix = matrixFromLive(config, response)
+	} else {
+		// Descriptions and access types only exist in the API's catalogue; without a token the
+		// matrix is still built, just without them.
+		var catalogue []CataloguePermission
+		if err := readAccessToken(config); err == nil {
+			if response, err := fetchPermissionMatrix(config); err == nil {
+				catalogue = response.Permissions
+			}
+		}
+		if catalogue == nil {
+			log.Println("- WARNING: permission catalogue unavailable, descriptions and inherited cells are left out.")
+		}
+		matrix = matrixFromConfig(config, catalogue)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fatalf("failed to create '%s': %v", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := write(out, matrix); err != nil {
+		fatalf("failed to write permission matrix: %v", err)
+	}
+	if *outPath != "" {
+		log.Printf("Permission matrix (%d permissions x %d roles) written to '%s'.", len(matrix.Permissions), len(matrix.Roles), *outPath)
+	}
+}
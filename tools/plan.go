@@ -0,0 +1,588 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Diff engine
+
+computePlan compares a desired RBAC state (config.json or a snapshot) with the live state and returns
+the ordered list of changes needed to converge. applyPlan executes such a list against the API.
+Objects are matched by name rather than ID, so a state can be applied to a different environment.
+*/
+
+type PlanOptions struct {
+	SkipRole                  func(name string) bool // roles left out of the diff entirely
+	GlobalRolePermissionsOnly bool                   // ignore non-Global permission grants held by roles
+	GroupPermissions          bool                   // diff permission grants held directly by groups
+	SyncMembers               bool                   // add and remove group members
+	UserGrants                bool                   // diff role and permission grants held directly by users
+	Prune                     bool                   // revoke/delete what is not desired instead of warning about it
+	AdoptedIds                map[string]bool        // lowercase IDs pruning may touch without a managed-by marker
+	IgnoreProvenance          bool                   // prune objects without a managed-by marker too (restore --all)
+
+	// KeepGroupGrant marks live group role grants another command maintains (team-links), which the diff leaves alone
+	KeepGroupGrant func(groupName string, grant StateRoleGrant) bool
+}
+
+type Change struct {
+	Action     string `json:"action"`
+	RoleName   string `json:"roleName,omitempty"`
+	GroupName  string `json:"groupName,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Permission string `json:"permission,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+	Member     string `json:"member,omitempty"`
+	User       string `json:"user,omitempty"`     // for grants held directly by a user
+	ObjectId   string `json:"objectId,omitempty"` // existing object for revocations and deletions
+	Expired    bool   `json:"expired,omitempty"`  // removal asked for by an expiry date in config.json
+}
+
+type Plan struct {
+	Changes  []Change `json:"changes"`
+	Warnings []string `json:"warnings"`
+
+	// IDs of the live objects the changes refer to, keyed like the diff (lowercase role name, exact group name)
+	RoleIds  map[string]string `json:"roleIds"`
+	GroupIds map[string]string `json:"groupIds"`
+}
+
+// Changes are applied in this order: creations before the grants that depend on them,
+// revocations before the deletions of the objects they hang off.
+var changeOrder = map[string]int{
+	"create-role":       0,
+	"grant-permission":  1,
+	"create-group":      2,
+	"grant-role":        3,
+	"add-member":        4,
+	"remove-member":     5,
+	"revoke-role":       6,
+	"revoke-permission": 7,
+	"delete-group":      8,
+	"delete-role":       9,
+}
+
+func (c Change) String() string {
+	target := fmt.Sprintf("role '%s'", c.RoleName)
+	holder := fmt.Sprintf("group '%s'", c.GroupName)
+	if c.GroupName != "" {
+		target = holder
+	}
+	if c.User != "" {
+		target, holder = fmt.Sprintf("user '%s'", c.User), fmt.Sprintf("user '%s'", c.User)
+	}
+	scope := c.Type
+	if c.Resource != "" && !strings.EqualFold(c.Type, "Global") {
+		scope = fmt.Sprintf("%s %s", c.Type, c.Resource)
+	}
+
+	switch c.Action {
+	case "create-role":
+		return fmt.Sprintf("create role '%s'", c.RoleName)
+	case "delete-role":
+		return fmt.Sprintf("delete role '%s' (%s)", c.RoleName, c.ObjectId)
+	case "create-group":
+		return fmt.Sprintf("create group '%s'", c.GroupName)
+	case "delete-group":
+		return fmt.Sprintf("delete group '%s' (%s)", c.GroupName, c.ObjectId)
+	case "grant-permission":
+		return fmt.Sprintf("grant permission '%s/%s' (%s) to %s", c.Namespace, c.Permission, scope, target)
+	case "revoke-permission":
+		return fmt.Sprintf("revoke permission '%s/%s' (%s) from %s", c.Namespace, c.Permission, scope, target)
+	case "grant-role":
+		return fmt.Sprintf("grant role '%s' (%s) to %s", c.RoleName, scope, holder)
+	case "revoke-role":
+		return fmt.Sprintf("revoke role '%s' (%s) from %s", c.RoleName, scope, holder)
+	case "add-member":
+		return fmt.Sprintf("add member '%s' to group '%s'", c.Member, c.GroupName)
+	case "remove-member":
+		return fmt.Sprintf("remove member '%s' from group '%s'", c.Member, c.GroupName)
+	default:
+		return c.Action
+	}
+}
+
+func (p *Plan) add(change Change) {
+	p.Changes = append(p.Changes, change)
+}
+
+func (p *Plan) warn(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (p *Plan) LogWarnings() {
+	for _, warning := range p.Warnings {
+		log.Printf("- WARNING: %s", warning)
+	}
+}
+
+func roleKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func memberKey(member string) string {
+	return strings.ToLower(strings.TrimSpace(member))
+}
+
+func permissionKey(p PermissionGrant) string {
+	return fmt.Sprintf(
+		"%s|%s|%s|%s",
+		strings.ToLower(strings.TrimSpace(p.Namespace)),
+		strings.ToLower(strings.TrimSpace(p.Permission)),
+		strings.ToLower(strings.TrimSpace(p.Type)),
+		normalizeGrantResource(p.Type, p.Resource),
+	)
+}
+
+func roleGrantKey(g StateRoleGrant) string {
+	return fmt.Sprintf(
+		"%s|%s|%s",
+		roleKey(g.RoleName),
+		strings.ToLower(strings.TrimSpace(g.Type)),
+		normalizeGrantResource(g.Type, g.Resource),
+	)
+}
+
+func computePlan(desired, live *RbacState, opts PlanOptions) *Plan {
+	plan := &Plan{RoleIds: make(map[string]string), GroupIds: make(map[string]string)}
+	skipRole := func(name string) bool {
+		return opts.SkipRole != nil && opts.SkipRole(name)
+	}
+	// Pruning is limited to objects the tool owns, see provenance.go.
+	owned := func(id, description string) bool {
+		return opts.IgnoreProvenance || isManagedDescription(description) || opts.AdoptedIds[strings.ToLower(id)]
+	}
+	now := time.Now().UTC()
+
+	/*
+	  Roles and their permissions
+	*/
+	desiredRoles := make(map[string]StateRole)
+	for _, role := range desired.Roles {
+		desiredRoles[roleKey(role.Name)] = role
+	}
+	// When several live roles share a name, the one whose ID the desired state pins (existingId) wins.
+	liveRoles := make(map[string]StateRole)
+	for _, role := range live.Roles {
+		key := roleKey(role.Name)
+		if existing, duplicate := liveRoles[key]; duplicate {
+			if strings.EqualFold(desiredRoles[key].ID, role.ID) {
+				existing, role = role, existing
+				liveRoles[key] = existing
+			}
+			plan.warn("roles '%s' and '%s' share the name '%s'; using '%s'. Run 'duplicates' to resolve.", existing.ID, role.ID, role.Name, existing.ID)
+			continue
+		}
+		liveRoles[key] = role
+	}
+	for key, role := range liveRoles {
+		plan.RoleIds[key] = role.ID
+	}
+
+	for _, role := range desired.Roles {
+		if skipRole(role.Name) {
+			continue
+		}
+
+		liveRole, exists := liveRoles[roleKey(role.Name)]
+		if !exists {
+			plan.add(Change{Action: "create-role", RoleName: role.Name, Type: role.Type})
+		}
+
+		livePermissions := liveRole.Permissions
+		if opts.GlobalRolePermissionsOnly {
+			livePermissions = filterGlobalPermissions(livePermissions)
+		}
+		missing, extra := diffPermissions(role.Permissions, livePermissions)
+		for _, p := range missing {
+			plan.add(Change{Action: "grant-permission", RoleName: role.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource})
+		}
+		for _, p := range extra {
+			if opts.Prune && !owned(liveRole.ID, liveRole.Description) {
+				plan.warn("role '%s' has unexpected permission '%s' in namespace '%s', but the role is not managed by this tool. Please review manually.", role.Name, p.Permission, p.Namespace)
+			} else if opts.Prune {
+				plan.add(Change{Action: "revoke-permission", RoleName: role.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID})
+			} else {
+				plan.warn("role '%s' has unexpected permission '%s' in namespace '%s'. Please review manually.", role.Name, p.Permission, p.Namespace)
+			}
+		}
+	}
+
+	for _, role := range live.Roles {
+		if skipRole(role.Name) {
+			continue
+		}
+		if _, expected := desiredRoles[roleKey(role.Name)]; expected || liveRoles[roleKey(role.Name)].ID != role.ID {
+			continue
+		}
+		if !opts.Prune {
+			plan.warn("role '%s' exists in the system but is not defined in %s. Please review manually.", role.Name, desired.Source)
+			continue
+		}
+		if !owned(role.ID, role.Description) {
+			plan.warn("role '%s' is not defined in %s and was not created by this tool; not deleting it. Please review manually.", role.Name, desired.Source)
+			continue
+		}
+		for _, p := range role.Permissions {
+			plan.add(Change{Action: "revoke-permission", RoleName: role.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID})
+		}
+		plan.add(Change{Action: "delete-role", RoleName: role.Name, ObjectId: role.ID})
+	}
+
+	/*
+	  Groups, their role bindings, permissions and members
+	*/
+	desiredGroups := make(map[string]StateGroup)
+	for _, group := range desired.Groups {
+		desiredGroups[group.Name] = group
+	}
+	liveGroups := make(map[string]StateGroup)
+	for _, group := range live.Groups {
+		if existing, duplicate := liveGroups[group.Name]; duplicate {
+			if strings.EqualFold(desiredGroups[group.Name].ID, group.ID) {
+				existing, group = group, existing
+				liveGroups[group.Name] = existing
+			}
+			plan.warn("groups '%s' and '%s' share the name '%s'; using '%s'. Run 'duplicates' to resolve.", existing.ID, group.ID, group.Name, existing.ID)
+			continue
+		}
+		liveGroups[group.Name] = group
+	}
+	for name, group := range liveGroups {
+		plan.GroupIds[name] = group.ID
+	}
+
+	for _, group := range desired.Groups {
+		liveGroup, exists := liveGroups[group.Name]
+		if !exists {
+			plan.add(Change{Action: "create-group", GroupName: group.Name})
+		}
+
+		liveGrants := make(map[string]StateRoleGrant)
+		for _, grant := range liveGroup.RoleGrants {
+			liveGrants[roleGrantKey(grant)] = grant
+		}
+		desiredGrants := make(map[string]StateRoleGrant)
+		expiredGrants := make(map[string]bool)
+		for _, grant := range group.RoleGrants {
+			key := roleGrantKey(grant)
+			if grant.Expires.expired(now) {
+				expiredGrants[key] = true
+				continue
+			}
+			desiredGrants[key] = grant
+			if _, granted := liveGrants[key]; !granted {
+				plan.add(Change{Action: "grant-role", GroupName: group.Name, RoleName: grant.RoleName, Type: grant.Type, Resource: normalizeGrantResource(grant.Type, grant.Resource)})
+			}
+		}
+		for _, grant := range liveGroup.RoleGrants {
+			if _, expected := desiredGrants[roleGrantKey(grant)]; expected {
+				continue
+			}
+			if opts.KeepGroupGrant != nil && opts.KeepGroupGrant(group.Name, grant) {
+				continue
+			}
+			// An expired binding is revoked even without pruning: config.json asked for it to end.
+			if expiredGrants[roleGrantKey(grant)] || (opts.Prune && owned(liveGroup.ID, liveGroup.Description)) {
+				plan.add(Change{Action: "revoke-role", GroupName: group.Name, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID, Expired: expiredGrants[roleGrantKey(grant)]})
+			} else {
+				plan.warn("group '%s' has unexpected role assignment (role='%s', type='%s', resource='%s'). Please review manually.", group.Name, grant.RoleName, grant.Type, grant.Resource)
+			}
+		}
+
+		if opts.GroupPermissions {
+			missing, extra := diffPermissions(group.Permissions, liveGroup.Permissions)
+			for _, p := range missing {
+				plan.add(Change{Action: "grant-permission", GroupName: group.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource})
+			}
+			for _, p := range extra {
+				if opts.Prune && owned(liveGroup.ID, liveGroup.Description) {
+					plan.add(Change{Action: "revoke-permission", GroupName: group.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID})
+				} else {
+					plan.warn("group '%s' has unexpected permission '%s' in namespace '%s'. Please review manually.", group.Name, p.Permission, p.Namespace)
+				}
+			}
+		}
+
+		liveMembers := make(map[string]bool)
+		for _, member := range liveGroup.Members {
+			liveMembers[memberKey(member)] = true
+		}
+		// Expired members are removed even when members are otherwise not synchronized.
+		expiredMembers := make(map[string]bool)
+		for _, member := range group.ExpiredMembers {
+			expiredMembers[memberKey(member)] = true
+			if liveMembers[memberKey(member)] {
+				plan.add(Change{Action: "remove-member", GroupName: group.Name, Member: member, Expired: true})
+			}
+		}
+
+		if opts.SyncMembers {
+			desiredMembers := make(map[string]bool)
+			for _, member := range group.Members {
+				if memberKey(member) == "" {
+					continue
+				}
+				desiredMembers[memberKey(member)] = true
+				if !liveMembers[memberKey(member)] {
+					plan.add(Change{Action: "add-member", GroupName: group.Name, Member: member})
+				}
+			}
+			for _, member := range liveGroup.Members {
+				if desiredMembers[memberKey(member)] || expiredMembers[memberKey(member)] {
+					continue
+				}
+				if owned(liveGroup.ID, liveGroup.Description) {
+					plan.add(Change{Action: "remove-member", GroupName: group.Name, Member: member})
+				} else {
+					plan.warn("group '%s' has unexpected member '%s', but the group is not managed by this tool. Please review manually.", group.Name, member)
+				}
+			}
+		}
+	}
+
+	/*
+	  Grants held directly by users, such as capability roles
+	*/
+	if opts.UserGrants {
+		desiredUsers := make(map[string]StateUser)
+		for _, user := range desired.Users {
+			desiredUsers[memberKey(user.ID)] = user
+		}
+		liveUsers := make(map[string]StateUser)
+		for _, user := range live.Users {
+			liveUsers[memberKey(user.ID)] = user
+		}
+		var userKeys []string
+		for key := range desiredUsers {
+			userKeys = append(userKeys, key)
+		}
+		for key := range liveUsers {
+			if _, desiredUser := desiredUsers[key]; !desiredUser {
+				userKeys = append(userKeys, key)
+			}
+		}
+		sort.Strings(userKeys)
+
+		for _, key := range userKeys {
+			user, liveUser := desiredUsers[key], liveUsers[key]
+			id := user.ID
+			if id == "" {
+				id = liveUser.ID
+			}
+
+			liveGrants := make(map[string]bool)
+			for _, grant := range liveUser.RoleGrants {
+				liveGrants[roleGrantKey(grant)] = true
+			}
+			desiredGrants := make(map[string]bool)
+			for _, grant := range user.RoleGrants {
+				desiredGrants[roleGrantKey(grant)] = true
+				if !liveGrants[roleGrantKey(grant)] {
+					plan.add(Change{Action: "grant-role", User: id, RoleName: grant.RoleName, Type: grant.Type, Resource: normalizeGrantResource(grant.Type, grant.Resource)})
+				}
+			}
+			for _, grant := range liveUser.RoleGrants {
+				if !desiredGrants[roleGrantKey(grant)] {
+					plan.add(Change{Action: "revoke-role", User: id, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID})
+				}
+			}
+
+			missing, extra := diffPermissions(user.Permissions, liveUser.Permissions)
+			for _, p := range missing {
+				plan.add(Change{Action: "grant-permission", User: id, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource})
+			}
+			for _, p := range extra {
+				plan.add(Change{Action: "revoke-permission", User: id, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID})
+			}
+		}
+	}
+
+	// Groups that config.json does not mention are left alone unless pruning: many are managed in the portal.
+	if opts.Prune {
+		for _, group := range live.Groups {
+			if _, expected := desiredGroups[group.Name]; expected || liveGroups[group.Name].ID != group.ID {
+				continue
+			}
+			if !owned(group.ID, group.Description) {
+				plan.warn("group '%s' is not in %s and was not created by this tool; not deleting it. Please review manually.", group.Name, desired.Source)
+				continue
+			}
+			for _, grant := range group.RoleGrants {
+				plan.add(Change{Action: "revoke-role", GroupName: group.Name, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID})
+			}
+			for _, p := range group.Permissions {
+				plan.add(Change{Action: "revoke-permission", GroupName: group.Name, Namespace: p.Namespace, Permission: p.Permission, Type: p.Type, Resource: p.Resource, ObjectId: p.ID})
+			}
+			plan.add(Change{Action: "delete-group", GroupName: group.Name, ObjectId: group.ID})
+		}
+	}
+
+	sort.SliceStable(plan.Changes, func(i, j int) bool {
+		return changeOrder[plan.Changes[i].Action] < changeOrder[plan.Changes[j].Action]
+	})
+
+	return plan
+}
+
+func filterGlobalPermissions(permissions []PermissionGrant) []PermissionGrant {
+	filtered := make([]PermissionGrant, 0, len(permissions))
+	for _, p := range permissions {
+		if strings.EqualFold(p.Type, "Global") {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// diffPermissions returns the desired grants missing from live, and the live grants that are not desired.
+func diffPermissions(desired, live []PermissionGrant) (missing, extra []PermissionGrant) {
+	liveKeys := make(map[string]bool, len(live))
+	for _, p := range live {
+		liveKeys[permissionKey(p)] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, p := range desired {
+		key := permissionKey(p)
+		if desiredKeys[key] {
+			continue
+		}
+		desiredKeys[key] = true
+		if !liveKeys[key] {
+			missing = append(missing, p)
+		}
+	}
+	for _, p := range live {
+		if !desiredKeys[permissionKey(p)] {
+			extra = append(extra, p)
+		}
+	}
+	return
+}
+
+// applyPlan executes the changes in order and stops at the first failure. Every applied change is
+// journaled by the API functions, so a partially applied plan can be rolled back.
+func applyPlan(config *Config, plan *Plan) {
+	enforceSafeguards(config, plan)
+
+	roleIds := make(map[string]string)
+	for key, id := range plan.RoleIds {
+		roleIds[key] = id
+	}
+	groupIds := make(map[string]string)
+	for name, id := range plan.GroupIds {
+		groupIds[name] = id
+	}
+
+	entity := func(change Change) (string, string) {
+		if change.User != "" {
+			return "User", change.User
+		}
+		if change.GroupName != "" {
+			return "Group", groupIds[change.GroupName]
+		}
+		return "Role", roleIds[roleKey(change.RoleName)]
+	}
+
+	for _, change := range plan.Changes {
+		log.Printf("- Applying: %s", change)
+
+		var err error
+		switch change.Action {
+		case "create-role":
+			id := createRole(config, Role{Name: change.RoleName, Type: change.Type})
+			if id == "" {
+				id, err = findRoleId(config, change.RoleName)
+			}
+			roleIds[roleKey(change.RoleName)] = id
+		case "create-group":
+			id := createGroup(config, change.GroupName)
+			if id == "" {
+				id, err = findGroupId(config, change.GroupName)
+			}
+			groupIds[change.GroupName] = id
+		case "grant-permission":
+			entityType, entityId := entity(change)
+			err = grantScopedPermission(config, PermissionGrantCreation{
+				Namespace:          change.Namespace,
+				Permission:         change.Permission,
+				Type:               change.Type,
+				Resource:           change.Resource,
+				AssignedEntityType: entityType,
+				AssignedEntityId:   entityId,
+			})
+		case "revoke-permission":
+			entityType, entityId := entity(change)
+			err = revokePermission(config, PermissionGrant{
+				ID:                 change.ObjectId,
+				Namespace:          change.Namespace,
+				Permission:         change.Permission,
+				Type:               change.Type,
+				Resource:           change.Resource,
+				AssignedEntityType: entityType,
+				AssignedEntityId:   entityId,
+			})
+		case "grant-role":
+			roleId, exists := roleIds[roleKey(change.RoleName)]
+			if !exists {
+				fatalf("cannot %s: role '%s' does not exist", change, change.RoleName)
+			}
+			entityType, entityId := entity(change)
+			err = assignRole(config, roleId, entityType, entityId, change.Type, change.Resource)
+		case "revoke-role":
+			entityType, entityId := entity(change)
+			err = revokeRole(config, RoleAssignment{
+				ID:                 change.ObjectId,
+				RoleId:             roleIds[roleKey(change.RoleName)],
+				AssignedEntityType: entityType,
+				AssignedEntityId:   entityId,
+				Type:               change.Type,
+				Resource:           change.Resource,
+			})
+		case "add-member":
+			err = createMembership(config, groupIds[change.GroupName], change.Member)
+		case "remove-member":
+			err = removeMembership(config, groupIds[change.GroupName], change.Member)
+		case "delete-group":
+			err = deleteGroup(config, change.ObjectId)
+		case "delete-role":
+			err = deleteRole(config, change.ObjectId)
+		default:
+			err = fmt.Errorf("unknown action '%s'", change.Action)
+		}
+
+		if err != nil {
+			fatalf("failed to %s: %v (run ID %s can be rolled back)", change, err, config.RunId)
+		}
+	}
+}
+
+func findRoleId(config *Config, name string) (string, error) {
+	roles, err := fetchRoles(config)
+	if err != nil {
+		return "", err
+	}
+	id, exists := roles[roleKey(name)]
+	if !exists {
+		return "", fmt.Errorf("role '%s' not found after creation", name)
+	}
+	return id, nil
+}
+
+func findGroupId(config *Config, name string) (string, error) {
+	groups, err := fetchGroups(config)
+	if err != nil {
+		return "", err
+	}
+	group, exists := groups[name]
+	if !exists {
+		return "", fmt.Errorf("group '%s' not found after creation", name)
+	}
+	return group.ID, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func planLines(plan *Plan) []string {
+	lines := make([]string, 0, len(plan.Changes))
+	for _, change := range plan.Changes {
+		line := change.String()
+		if change.Expired {
+			line += " [expired]"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func globalPermission(namespace, permission string) PermissionGrant {
+	return PermissionGrant{Namespace: namespace, Permission: permission, Type: "Global", Resource: "*"}
+}
+
+func globalBinding(roleName string) StateRoleGrant {
+	return StateRoleGrant{RoleAssignment: RoleAssignment{Type: "Global"}, RoleName: roleName}
+}
+
+func TestComputePlan(t *testing.T) {
+	expired := &ExpiryDate{time.Now().UTC().AddDate(0, 0, -2)}
+	managed := managedDescription("role", "Old")
+
+	tests := []struct {
+		name         string
+		desired      *RbacState
+		live         *RbacState
+		opts         PlanOptions
+		want         []string
+		wantWarnings int
+	}{
+		{
+			name: "creations come before the grants that depend on them",
+			desired: &RbacState{
+				Roles:  []StateRole{{Name: "Reader", Type: "Global", Permissions: []PermissionGrant{globalPermission("topics", "read")}}},
+				Groups: []StateGroup{{Name: "Readers", Members: []string{"a@dfds.com"}, RoleGrants: []StateRoleGrant{globalBinding("Reader")}}},
+			},
+			live: &RbacState{},
+			opts: PlanOptions{SyncMembers: true},
+			want: []string{
+				"create role 'Reader'",
+				"grant permission 'topics/read' (Global) to role 'Reader'",
+				"create group 'Readers'",
+				"grant role 'Reader' (Global) to group 'Readers'",
+				"add member 'a@dfds.com' to group 'Readers'",
+			},
+		},
+		{
+			name:    "roles and members match without case",
+			desired: &RbacState{Groups: []StateGroup{{Name: "Readers", Members: []string{"A@dfds.com"}, RoleGrants: []StateRoleGrant{globalBinding("reader")}}}},
+			live:    &RbacState{Groups: []StateGroup{{ID: "g1", Name: "Readers", Members: []string{"a@dfds.com"}, RoleGrants: []StateRoleGrant{globalBinding("Reader")}}}},
+			opts:    PlanOptions{SyncMembers: true},
+		},
+		{
+			name:         "extra permissions are only warned about without pruning",
+			desired:      &RbacState{Roles: []StateRole{{Name: "Reader"}}},
+			live:         &RbacState{Roles: []StateRole{{ID: "r1", Name: "Reader", Description: managed, Permissions: []PermissionGrant{globalPermission("topics", "create")}}}},
+			wantWarnings: 1,
+		},
+		{
+			name:    "pruning revokes from and deletes roles the tool owns",
+			desired: &RbacState{},
+			live: &RbacState{Roles: []StateRole{
+				{ID: "r1", Name: "Old", Description: managed, Permissions: []PermissionGrant{globalPermission("topics", "read")}},
+				{ID: "r2", Name: "Portal", Description: "made in the portal"},
+			}},
+			opts: PlanOptions{Prune: true},
+			want: []string{
+				"revoke permission 'topics/read' (Global) from role 'Old'",
+				"delete role 'Old' (r1)",
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:    "pruning treats adopted IDs as owned",
+			desired: &RbacState{},
+			live:    &RbacState{Roles: []StateRole{{ID: "R2", Name: "Portal", Description: "made in the portal"}}},
+			opts:    PlanOptions{Prune: true, AdoptedIds: map[string]bool{"r2": true}},
+			want:    []string{"delete role 'Portal' (R2)"},
+		},
+		{
+			name:    "restore --all prunes regardless of provenance",
+			desired: &RbacState{},
+			live:    &RbacState{Groups: []StateGroup{{ID: "g1", Name: "Portal", RoleGrants: []StateRoleGrant{globalBinding("Reader")}}}},
+			opts:    PlanOptions{Prune: true, IgnoreProvenance: true},
+			want: []string{
+				"revoke role 'Reader' (Global) from group 'Portal'",
+				"delete group 'Portal' (g1)",
+			},
+		},
+		{
+			name: "expired bindings and members are removed without pruning or member sync",
+			desired: &RbacState{Groups: []StateGroup{{
+				Name:           "Admins",
+				ExpiredMembers: []string{"contractor@dfds.com"},
+				RoleGrants:     []StateRoleGrant{{RoleAssignment: RoleAssignment{Type: "Global"}, RoleName: "CloudEngineer", Expires: expired}},
+			}}},
+			live: &RbacState{Groups: []StateGroup{{
+				ID:         "g1",
+				Name:       "Admins",
+				Members:    []string{"contractor@dfds.com", "someone@dfds.com"},
+				RoleGrants: []StateRoleGrant{globalBinding("CloudEngineer")},
+			}}},
+			want: []string{
+				"remove member 'contractor@dfds.com' from group 'Admins' [expired]",
+				"revoke role 'CloudEngineer' (Global) from group 'Admins' [expired]",
+			},
+		},
+		{
+			name:    "a replaced binding is granted before the old one is revoked",
+			desired: &RbacState{Groups: []StateGroup{{Name: "Team", RoleGrants: []StateRoleGrant{globalBinding("Contributor")}}}},
+			live:    &RbacState{Groups: []StateGroup{{ID: "g1", Name: "Team", Description: managed, RoleGrants: []StateRoleGrant{globalBinding("Reader")}}}},
+			opts:    PlanOptions{Prune: true},
+			want: []string{
+				"grant role 'Contributor' (Global) to group 'Team'",
+				"revoke role 'Reader' (Global) from group 'Team'",
+			},
+		},
+		{
+			name: "user grants are diffed only when asked for",
+			desired: &RbacState{Users: []StateUser{{ID: "a@dfds.com", RoleGrants: []StateRoleGrant{
+				{RoleAssignment: RoleAssignment{Type: "Capability", Resource: "cap-a"}, RoleName: "Owner"},
+			}}}},
+			live: &RbacState{Users: []StateUser{{ID: "a@dfds.com", RoleGrants: []StateRoleGrant{
+				{RoleAssignment: RoleAssignment{ID: "x1", Type: "Capability", Resource: "cap-b"}, RoleName: "Owner"},
+			}}}},
+		},
+		{
+			name: "user grants are granted before they are revoked",
+			desired: &RbacState{Users: []StateUser{{ID: "a@dfds.com", RoleGrants: []StateRoleGrant{
+				{RoleAssignment: RoleAssignment{Type: "Capability", Resource: "cap-a"}, RoleName: "Owner"},
+			}}}},
+			live: &RbacState{Users: []StateUser{
+				{ID: "a@dfds.com", RoleGrants: []StateRoleGrant{{RoleAssignment: RoleAssignment{ID: "x1", Type: "Capability", Resource: "cap-b"}, RoleName: "Owner"}}},
+				{ID: "b@dfds.com", Permissions: []PermissionGrant{{ID: "p1", Namespace: "topics", Permission: "read", Type: "Capability", Resource: "cap-b"}}},
+			}},
+			opts: PlanOptions{UserGrants: true},
+			want: []string{
+				"grant role 'Owner' (Capability cap-a) to user 'a@dfds.com'",
+				"revoke role 'Owner' (Capability cap-b) from user 'a@dfds.com'",
+				"revoke permission 'topics/read' (Capability cap-b) from user 'b@dfds.com'",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := computePlan(test.desired, test.live, test.opts)
+			if got := planLines(plan); !reflect.DeepEqual(got, append([]string{}, test.want...)) {
+				t.Errorf("changes:\n got %q\nwant %q", got, test.want)
+			}
+			if len(plan.Warnings) != test.wantWarnings {
+				t.Errorf("got %d warnings %q, want %d", len(plan.Warnings), plan.Warnings, test.wantWarnings)
+			}
+		})
+	}
+}
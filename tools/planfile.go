@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Plan files
+
+`plan` saves the baseline diff as an artifact that can be reviewed and approved, and `apply` executes
+exactly that artifact. The file records hashes of config.json and of the live state the diff was computed
+from; apply refuses to run when either no longer matches, since the approved changes would then not be
+what the environment needs.
+
+The file carries a hash over its own contents. When RBAC_PLAN_SIGNING_KEY is set it is an HMAC with that
+key, so only holders of the key can produce a plan apply accepts; without a key it is a plain SHA-256,
+which catches edits to the file but not someone who recomputes the hash.
+*/
+
+const (
+	planFileVersion      = 1
+	planSigningKeyEnvVar = "RBAC_PLAN_SIGNING_KEY"
+	defaultPlanPath      = "rbac-plan.json"
+)
+
+type PlanFile struct {
+	Version       int       `json:"version"`
+	CreatedAt     time.Time `json:"createdAt"`
+	CreatedBy     string    `json:"createdBy"`
+	ApiUrl        string    `json:"apiUrl"`
+	ConfigHash    string    `json:"configHash"`
+	LiveStateHash string    `json:"liveStateHash"`
+	Plan          Plan      `json:"plan"`
+	Signed        bool      `json:"signed"`
+	Hash          string    `json:"hash"` // over all fields above, see planFileHash
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(file)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashState hashes the parts of a state the plan depends on. Capture time is left out and every list is
+// sorted, so two fetches of an unchanged environment hash the same.
+func hashState(state *RbacState) string {
+	canonical := RbacState{ApiUrl: state.ApiUrl}
+
+	sortGrants := func(grants []PermissionGrant) []PermissionGrant {
+		sorted := append([]PermissionGrant{}, grants...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].ID+permissionKey(sorted[i]) < sorted[j].ID+permissionKey(sorted[j])
+		})
+		return sorted
+	}
+
+	for _, role := range state.Roles {
+		role.Permissions = sortGrants(role.Permissions)
+		canonical.Roles = append(canonical.Roles, role)
+	}
+	sort.Slice(canonical.Roles, func(i, j int) bool {
+		return canonical.Roles[i].ID+canonical.Roles[i].Name < canonical.Roles[j].ID+canonical.Roles[j].Name
+	})
+
+	for _, group := range state.Groups {
+		group.Members = append([]string{}, group.Members...)
+		sort.Strings(group.Members)
+		group.Permissions = sortGrants(group.Permissions)
+		group.RoleGrants = append([]StateRoleGrant{}, group.RoleGrants...)
+		sort.Slice(group.RoleGrants, func(i, j int) bool {
+			return group.RoleGrants[i].ID+roleGrantKey(group.RoleGrants[i]) < group.RoleGrants[j].ID+roleGrantKey(group.RoleGrants[j])
+		})
+		canonical.Groups = append(canonical.Groups, group)
+	}
+	sort.Slice(canonical.Groups, func(i, j int) bool {
+		return canonical.Groups[i].ID+canonical.Groups[i].Name < canonical.Groups[j].ID+canonical.Groups[j].Name
+	})
+
+	body, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func planFileHash(planFile PlanFile, key string) string {
+	planFile.Hash = ""
+	body, _ := json.Marshal(planFile)
+
+	if key == "" {
+		sum := sha256.Sum256(body)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func loadPlanFile(path string) (*PlanFile, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var planFile PlanFile
+	if err := json.Unmarshal(file, &planFile); err != nil {
+		return nil, err
+	}
+	if planFile.Version != planFileVersion {
+		return nil, fmt.Errorf("unsupported plan file version %d", planFile.Version)
+	}
+
+	key := os.Getenv(planSigningKeyEnvVar)
+	switch {
+	case planFile.Signed && key == "":
+		return nil, fmt.Errorf("plan is signed but %s is not set", planSigningKeyEnvVar)
+	case !planFile.Signed && key != "":
+		return nil, fmt.Errorf("plan is not signed but %s is set; only signed plans are accepted", planSigningKeyEnvVar)
+	}
+	if !hmac.Equal([]byte(planFileHash(planFile, key)), []byte(planFile.Hash)) {
+		return nil, fmt.Errorf("plan hash does not match its contents, the file was modified after it was written")
+	}
+
+	return &planFile, nil
+}
+
+/*
+Commands
+*/
+
+func runPlan(config *Config, configPath, outPath string) {
+	log.Printf(">> Planning baseline changes for %s...", config.ApiUrl)
+
+	configHash, err := hashFile(configPath)
+	if err != nil {
+		fatalf("failed to hash '%s': %v", configPath, err)
+	}
+
+	live, err := fetchState(config, false)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+
+	plan := computeBaselinePlan(config, live)
+	plan.LogWarnings()
+
+	key := os.Getenv(planSigningKeyEnvVar)
+	planFile := PlanFile{
+		Version:       planFileVersion,
+		CreatedAt:     time.Now().UTC(),
+		CreatedBy:     fetchOperator(config),
+		ApiUrl:        config.ApiUrl,
+		ConfigHash:    configHash,
+		LiveStateHash: hashState(live),
+		Plan:          *plan,
+		Signed:        key != "",
+	}
+	planFile.Hash = planFileHash(planFile, key)
+
+	body, err := json.MarshalIndent(planFile, "", "    ")
+	if err != nil {
+		fatalf("failed to encode plan: %v", err)
+	}
+	if err := os.WriteFile(outPath, body, 0644); err != nil {
+		fatalf("failed to write plan '%s': %v", outPath, err)
+	}
+
+	for _, change := range plan.Changes {
+		log.Printf("  %s", change)
+	}
+	for _, violation := range checkSafeguards(config, plan) {
+		log.Printf("- WARNING: %s. Apply will refuse this plan.", violation)
+	}
+	if !planFile.Signed {
+		log.Printf("- WARNING: %s is not set, the plan is hashed but not signed.", planSigningKeyEnvVar)
+	}
+	log.Printf("<< Plan with %d change(s) written to '%s'.", len(plan.Changes), outPath)
+}
+
+// loadApprovedPlan checks a plan file against its hash, the target environment and config.json. It runs
+// before the run lock is taken, so a refused plan leaves no lock behind.
+func loadApprovedPlan(config *Config, configPath, planPath string) *PlanFile {
+	planFile, err := loadPlanFile(planPath)
+	if err != nil {
+		fatalf("refusing to apply '%s': %v", planPath, err)
+	}
+
+	if !strings.EqualFold(strings.TrimSuffix(planFile.ApiUrl, "/"), strings.TrimSuffix(config.ApiUrl, "/")) {
+		fatalf("refusing to apply '%s': plan was made for %s, not %s", planPath, planFile.ApiUrl, config.ApiUrl)
+	}
+
+	configHash, err := hashFile(configPath)
+	if err != nil {
+		fatalf("failed to hash '%s': %v", configPath, err)
+	}
+	if configHash != planFile.ConfigHash {
+		fatalf("refusing to apply '%s': %s changed since the plan was made, create a new plan", planPath, configPath)
+	}
+
+	return planFile
+}
+
+// runApply executes an approved plan if the live state still matches the one it was made from. Must run
+// between startRun and finishRun.
+func runApply(config *Config, planFile *PlanFile, planPath string) {
+	log.Printf(">> Applying plan '%s' (created %s by %s, %d change(s))...",
+		planPath, planFile.CreatedAt.Format(time.RFC3339), planFile.CreatedBy, len(planFile.Plan.Changes))
+
+	// The run lock is held from here on, so the state checked is the state the plan is applied to.
+	live, err := fetchState(config, false)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+	if hashState(live) != planFile.LiveStateHash {
+		fatalf("refusing to apply '%s': the live RBAC state changed since the plan was made, create a new plan", planPath)
+	}
+
+	if len(planFile.Plan.Changes) == 0 {
+		log.Println("<< Plan has no changes.")
+		return
+	}
+
+	snapshotPath, err := saveSnapshot(config, live)
+	if err != nil {
+		fatalf("failed to write pre-apply snapshot: %v", err)
+	}
+	log.Printf("Pre-apply snapshot written to '%s'.", snapshotPath)
+
+	applyPlan(config, &planFile.Plan)
+
+	log.Printf("<< Plan applied: %d change(s).", len(planFile.Plan.Changes))
+}
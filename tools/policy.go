@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+Policy evaluation
+
+Answers "is principal X permitted namespace/permission on object Y" against an RBAC state, following
+IsUserPermitted behind POST /rbac/can-they:
+
+  - permission and role grants are collected from the user and from every group the user is a member of
+  - for a capability scoped check where the user holds no capability role grant on the object, the Guest
+    role's permissions are added as capability grants on the object
+  - permissions held through a role take the type and resource of the role grant
+  - a grant applies when it is Global or its resource equals the object ID, and its namespace and
+    permission equal the requested ones
+
+As in the API, namespace, permission, resource and group membership comparisons are exact; user and
+role IDs are compared ignoring case.
+
+Capability roles such as Owner are mostly granted to users directly. Those grants are only in the live
+state and in snapshots, not in config.json, so evaluate capability access with --live or --snapshot.
+`explain --cases policy-cases.json` checks the engine itself against a fixed state with known answers.
+*/
+
+type AccessRequest struct {
+	Principal  string `json:"principal"`
+	Namespace  string `json:"namespace"`
+	Permission string `json:"permission"`
+	AccessType string `json:"accessType,omitempty"` // Global or Capability; looked up in the catalogue when empty
+	ObjectId   string `json:"objectId,omitempty"`
+}
+
+func (r AccessRequest) String() string {
+	if r.ObjectId == "" {
+		return fmt.Sprintf("%s %s/%s", r.Principal, r.Namespace, r.Permission)
+	}
+	return fmt.Sprintf("%s %s/%s on %s", r.Principal, r.Namespace, r.Permission, r.ObjectId)
+}
+
+// GrantPath is one way the principal holds the requested permission, whether or not it applies to the object.
+type GrantPath struct {
+	Via      string // "user" or "group '<name>'"
+	Role     string // empty for direct permission grants
+	Type     string
+	Resource string
+	Applies  bool
+}
+
+func (p GrantPath) String() string {
+	scope := p.Type
+	if !strings.EqualFold(p.Type, "Global") {
+		scope = fmt.Sprintf("%s %s", p.Type, p.Resource)
+	}
+	if p.Role == "" {
+		return fmt.Sprintf("direct permission grant to %s (%s)", p.Via, scope)
+	}
+	return fmt.Sprintf("role '%s' granted to %s (%s)", p.Role, p.Via, scope)
+}
+
+type AccessDecision struct {
+	Request   AccessRequest
+	Permitted bool
+	Paths     []GrantPath
+	Notes     []string
+}
+
+// Explain lists every grant path that was considered and why the request was allowed or denied.
+func (d AccessDecision) Explain() string {
+	var b strings.Builder
+	if d.Permitted {
+		fmt.Fprintf(&b, "ALLOW %s\n", d.Request)
+	} else {
+		fmt.Fprintf(&b, "DENY  %s\n", d.Request)
+	}
+	for _, note := range d.Notes {
+		fmt.Fprintf(&b, "  - %s\n", note)
+	}
+	for _, path := range d.Paths {
+		if path.Applies {
+			fmt.Fprintf(&b, "  + %s\n", path)
+		} else {
+			fmt.Fprintf(&b, "  x %s: does not cover '%s'\n", path, d.Request.ObjectId)
+		}
+	}
+	if len(d.Paths) == 0 {
+		fmt.Fprintf(&b, "  x no grant of %s/%s reaches %s\n", d.Request.Namespace, d.Request.Permission, d.Request.Principal)
+	}
+	return b.String()
+}
+
+type PolicyEngine struct {
+	state       *RbacState
+	accessTypes map[string]string // matrixKey -> access type from the catalogue
+}
+
+func newPolicyEngine(state *RbacState, catalogue []CataloguePermission) *PolicyEngine {
+	engine := &PolicyEngine{state: state, accessTypes: make(map[string]string, len(catalogue))}
+	for _, permission := range catalogue {
+		engine.accessTypes[matrixKey(permission.Namespace, permission.Name)] = permission.AccessType
+	}
+	return engine
+}
+
+func (e *PolicyEngine) findRole(grant StateRoleGrant) *StateRole {
+	for i, role := range e.state.Roles {
+		if grant.RoleId != "" && strings.EqualFold(role.ID, grant.RoleId) {
+			return &e.state.Roles[i]
+		}
+	}
+	for i, role := range e.state.Roles {
+		if roleKey(role.Name) == roleKey(grant.RoleName) {
+			return &e.state.Roles[i]
+		}
+	}
+	return nil
+}
+
+func (e *PolicyEngine) guestRole() *StateRole {
+	for i, role := range e.state.Roles {
+		if shouldSkipRole(role.Name) {
+			return &e.state.Roles[i]
+		}
+	}
+	return nil
+}
+
+func grantApplies(grantType, resource, objectId string) bool {
+	return strings.EqualFold(grantType, "Global") || resource == objectId
+}
+
+func (e *PolicyEngine) Evaluate(request AccessRequest) AccessDecision {
+	decision := AccessDecision{Request: request}
+
+	accessType := request.AccessType
+	if accessType == "" {
+		accessType = e.accessTypes[matrixKey(request.Namespace, request.Permission)]
+		if accessType == "" {
+			accessType = "Global"
+			decision.Notes = append(decision.Notes, fmt.Sprintf("access type of %s/%s unknown, evaluated as Global", request.Namespace, request.Permission))
+		}
+	}
+
+	type roleGrant struct {
+		via   string
+		grant StateRoleGrant
+	}
+	type permissionGrant struct {
+		via   string
+		role  string
+		grant PermissionGrant
+	}
+	var roleGrants []roleGrant
+	var permissionGrants []permissionGrant
+
+	if !e.state.UsersCaptured && len(e.state.Users) == 0 {
+		decision.Notes = append(decision.Notes, fmt.Sprintf("%s holds no direct user grants, capability roles granted to users are not considered", e.state.Source))
+	}
+	for _, user := range e.state.Users {
+		if strings.EqualFold(user.ID, request.Principal) {
+			for _, grant := range user.RoleGrants {
+				roleGrants = append(roleGrants, roleGrant{"user", grant})
+			}
+			for _, grant := range user.Permissions {
+				permissionGrants = append(permissionGrants, permissionGrant{"user", "", grant})
+			}
+		}
+	}
+	for _, group := range e.state.Groups {
+		member := false
+		for _, email := range group.Members {
+			member = member || email == request.Principal
+		}
+		if !member {
+			continue
+		}
+		via := fmt.Sprintf("group '%s'", group.Name)
+		for _, grant := range group.RoleGrants {
+			roleGrants = append(roleGrants, roleGrant{via, grant})
+		}
+		for _, grant := range group.Permissions {
+			permissionGrants = append(permissionGrants, permissionGrant{via, "", grant})
+		}
+	}
+
+	if strings.EqualFold(accessType, "Capability") {
+		hasCapabilityRole := false
+		for _, rg := range roleGrants {
+			hasCapabilityRole = hasCapabilityRole || (strings.EqualFold(rg.grant.Type, "Capability") && rg.grant.Resource == request.ObjectId)
+		}
+		if !hasCapabilityRole {
+			if guest := e.guestRole(); guest != nil {
+				decision.Notes = append(decision.Notes, fmt.Sprintf("no capability role on '%s', Guest permissions apply", request.ObjectId))
+				for _, grant := range guest.Permissions {
+					grant.Type, grant.Resource = "Capability", request.ObjectId
+					permissionGrants = append(permissionGrants, permissionGrant{"everyone without a capability role", guest.Name, grant})
+				}
+			}
+		}
+	}
+
+	for _, pg := range permissionGrants {
+		if pg.grant.Namespace != request.Namespace || pg.grant.Permission != request.Permission {
+			continue
+		}
+		path := GrantPath{Via: pg.via, Role: pg.role, Type: pg.grant.Type, Resource: pg.grant.Resource}
+		path.Applies = grantApplies(path.Type, path.Resource, request.ObjectId)
+		decision.Paths = append(decision.Paths, path)
+	}
+
+	for _, rg := range roleGrants {
+		role := e.findRole(rg.grant)
+		if role == nil {
+			decision.Notes = append(decision.Notes, fmt.Sprintf("role '%s' granted to %s is not defined in %s", rg.grant.RoleName, rg.via, e.state.Source))
+			continue
+		}
+		for _, grant := range role.Permissions {
+			if grant.Namespace != request.Namespace || grant.Permission != request.Permission {
+				continue
+			}
+			path := GrantPath{Via: rg.via, Role: role.Name, Type: rg.grant.Type, Resource: rg.grant.Resource}
+			path.Applies = grantApplies(path.Type, path.Resource, request.ObjectId)
+			decision.Paths = append(decision.Paths, path)
+		}
+	}
+
+	for _, path := range decision.Paths {
+		decision.Permitted = decision.Permitted || path.Applies
+	}
+
+	return decision
+}
+
+/*
+Command
+*/
+
+// runExplain evaluates a single request against config.json, a snapshot or the live environment and
+// prints the grant paths. With --cases it checks the engine against a policy cases file instead.
+func runExplain(config *Config, args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	snapshotPath := flags.String("snapshot", "", "evaluate against a snapshot instead of config.json")
+	live := flags.Bool("live", false, "evaluate against the live environment instead of config.json")
+	casesPath := flags.String("cases", "", "check the policy cases in this file and exit")
+	objectId := flags.String("object", "", "capability or other object ID the permission is checked on")
+	accessType := flags.String("access-type", "", "Global or Capability (default: from the permission catalogue)")
+	flags.Parse(args)
+
+	if *casesPath != "" {
+		if !runPolicyCases(*casesPath) {
+			os.Exit(1)
+		}
+		return
+	}
+	if flags.NArg() != 3 {
+		fatalf("usage: explain [--snapshot <file> | --live] [--object <id>] [--access-type <type>] <principal> <namespace> <permission>")
+	}
+
+	state := desiredStateFromConfig(config)
+	switch {
+	case *snapshotPath != "":
+		var err error
+		if state, err = loadSnapshot(*snapshotPath); err != nil {
+			fatalf("failed to load snapshot '%s': %v", *snapshotPath, err)
+		}
+	case *live:
+		if err := readAccessToken(config); err != nil {
+			fatalf("%v", err)
+		}
+		var err error
+		if state, err = fetchState(config, true); err != nil {
+			fatalf("failed to fetch RBAC state: %v", err)
+		}
+	}
+
+	var catalogue []CataloguePermission
+	if *accessType == "" {
+		if err := readAccessToken(config); err == nil {
+			if response, err := fetchPermissionMatrix(config); err == nil {
+				catalogue = response.Permissions
+			}
+		}
+	}
+
+	decision := newPolicyEngine(state, catalogue).Evaluate(AccessRequest{
+		Principal:  flags.Arg(0),
+		Namespace:  flags.Arg(1),
+		Permission: flags.Arg(2),
+		AccessType: *accessType,
+		ObjectId:   *objectId,
+	})
+	fmt.Print(decision.Explain())
+
+	if !decision.Permitted {
+		os.Exit(1)
+	}
+}
+
+/*
+Policy cases
+
+A policy cases file is a small RBAC state in snapshot format next to assertions in the format verify
+uses. Each assertion is evaluated by the engine against that state, so a change to the engine that
+breaks a known answer, e.g. a user's Owner grant on a capability, shows up without an environment.
+*/
+
+type PolicyCases struct {
+	State RbacState `json:"state"`
+}
+
+func runPolicyCases(path string) bool {
+	assertions, err := loadAssertions(path)
+	if err != nil {
+		fatalf("failed to load policy cases '%s': %v", path, err)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		fatalf("failed to load policy cases '%s': %v", path, err)
+	}
+	var cases PolicyCases
+	if err := json.Unmarshal(file, &cases); err != nil {
+		fatalf("failed to load policy cases '%s': %v", path, err)
+	}
+	cases.State.Source = path
+	engine := newPolicyEngine(&cases.State, nil)
+
+	passed, failed := 0, 0
+	for _, assertion := range assertions {
+		accessType, objectId := "Global", assertion.ObjectId
+		if assertion.Capability != "" {
+			accessType, objectId = "Capability", assertion.Capability
+		}
+
+		principals := []string{assertion.User}
+		switch {
+		case assertion.Guest:
+			principals = []string{guestPrincipal}
+		case assertion.MemberOf != "":
+			principals = nil
+			for _, group := range cases.State.Groups {
+				if group.Name == assertion.MemberOf {
+					principals = append(principals, group.Members...)
+				}
+			}
+		}
+		if len(principals) == 0 {
+			fmt.Printf("FAIL %s: group '%s' has no members in the cases state\n", assertion, assertion.MemberOf)
+			failed++
+			continue
+		}
+
+		expectations := map[string]bool{}
+		for _, permission := range assertion.Can {
+			expectations[permission] = true
+		}
+		for _, permission := range assertion.Cannot {
+			expectations[permission] = false
+		}
+		for _, principal := range principals {
+			for _, permission := range append(append([]string{}, assertion.Can...), assertion.Cannot...) {
+				namespace, name, _ := splitPermission(permission)
+				decision := engine.Evaluate(AccessRequest{
+					Principal:  principal,
+					Namespace:  namespace,
+					Permission: name,
+					AccessType: accessType,
+					ObjectId:   objectId,
+				})
+				if decision.Permitted == expectations[permission] {
+					passed++
+					continue
+				}
+				failed++
+				fmt.Printf("FAIL %s: expected %s, got\n%s", assertion, canLabel(expectations[permission]), decision.Explain())
+			}
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("Policy cases failed: %d passed, %d failed.", passed, failed)
+		return false
+	}
+	log.Printf("Policy cases passed: %d check(s).", passed)
+	return true
+}
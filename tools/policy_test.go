@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func policyTestState() *RbacState {
+	capabilityPermission := func(namespace, permission string) PermissionGrant {
+		return PermissionGrant{Namespace: namespace, Permission: permission, Type: "Capability", Resource: "*"}
+	}
+	return &RbacState{
+		Source: "test",
+		Roles: []StateRole{
+			{ID: "role-owner", Name: "Owner", Type: "Capability", Permissions: []PermissionGrant{
+				capabilityPermission("topics", "create"),
+				capabilityPermission("topics", "read-public"),
+			}},
+			{ID: "role-guest", Name: "Guest", Type: "Capability", Permissions: []PermissionGrant{
+				capabilityPermission("topics", "read-public"),
+			}},
+			{ID: "role-cloudengineer", Name: "CloudEngineer", Type: "Global", Permissions: []PermissionGrant{
+				globalPermission("rbac", "read"),
+			}},
+		},
+		Groups: []StateGroup{
+			{
+				Name:        "CloudEngineers",
+				Members:     []string{"engineer@dfds.com"},
+				RoleGrants:  []StateRoleGrant{globalBinding("cloudengineer")},
+				Permissions: []PermissionGrant{{Namespace: "topics", Permission: "delete", Type: "Capability", Resource: "cap-a"}},
+			},
+		},
+		Users: []StateUser{
+			{ID: "owner@dfds.com", RoleGrants: []StateRoleGrant{
+				{RoleAssignment: RoleAssignment{RoleId: "ROLE-OWNER", Type: "Capability", Resource: "cap-a"}, RoleName: "Owner"},
+			}},
+		},
+		UsersCaptured: true,
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	catalogue := []CataloguePermission{
+		{Namespace: "topics", Name: "create", AccessType: "Capability"},
+		{Namespace: "topics", Name: "read-public", AccessType: "Capability"},
+		{Namespace: "topics", Name: "delete", AccessType: "Capability"},
+		{Namespace: "rbac", Name: "read", AccessType: "Global"},
+	}
+
+	tests := []struct {
+		name      string
+		request   AccessRequest
+		permitted bool
+		note      string // expected in the decision's notes
+	}{
+		{
+			name:      "a capability role grant applies on its capability",
+			request:   AccessRequest{Principal: "OWNER@dfds.com", Namespace: "topics", Permission: "create", ObjectId: "cap-a"},
+			permitted: true,
+		},
+		{
+			name:      "a capability role grant does not reach other capabilities",
+			request:   AccessRequest{Principal: "owner@dfds.com", Namespace: "topics", Permission: "create", ObjectId: "cap-b"},
+			permitted: false,
+			note:      "Guest permissions apply",
+		},
+		{
+			name:      "without a capability role the Guest permissions apply",
+			request:   AccessRequest{Principal: "nobody@dfds.com", Namespace: "topics", Permission: "read-public", ObjectId: "cap-b"},
+			permitted: true,
+			note:      "Guest permissions apply",
+		},
+		{
+			name:      "Guest does not apply to Global checks",
+			request:   AccessRequest{Principal: "nobody@dfds.com", Namespace: "rbac", Permission: "read"},
+			permitted: false,
+		},
+		{
+			name:      "group role grants reach members, matching the role without case",
+			request:   AccessRequest{Principal: "engineer@dfds.com", Namespace: "rbac", Permission: "read"},
+			permitted: true,
+		},
+		{
+			name:      "group membership is compared exactly",
+			request:   AccessRequest{Principal: "Engineer@dfds.com", Namespace: "rbac", Permission: "read"},
+			permitted: false,
+		},
+		{
+			name:      "direct group permission grants apply on their resource only",
+			request:   AccessRequest{Principal: "engineer@dfds.com", Namespace: "topics", Permission: "delete", ObjectId: "cap-b"},
+			permitted: false,
+		},
+		{
+			name:      "direct group permission grants apply on their resource",
+			request:   AccessRequest{Principal: "engineer@dfds.com", Namespace: "topics", Permission: "delete", ObjectId: "cap-a"},
+			permitted: true,
+		},
+		{
+			name:      "unknown access types are evaluated as Global",
+			request:   AccessRequest{Principal: "engineer@dfds.com", Namespace: "kafka", Permission: "read"},
+			permitted: false,
+			note:      "evaluated as Global",
+		},
+	}
+
+	engine := newPolicyEngine(policyTestState(), catalogue)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := engine.Evaluate(test.request)
+			if decision.Permitted != test.permitted {
+				t.Errorf("permitted = %v, want %v\n%s", decision.Permitted, test.permitted, decision.Explain())
+			}
+			if test.note != "" && !strings.Contains(strings.Join(decision.Notes, "\n"), test.note) {
+				t.Errorf("notes %q do not mention %q", decision.Notes, test.note)
+			}
+		})
+	}
+}
+
+func TestEvaluateWithoutUserGrants(t *testing.T) {
+	state := policyTestState()
+	state.Users, state.UsersCaptured = nil, false
+
+	decision := newPolicyEngine(state, nil).Evaluate(AccessRequest{Principal: "owner@dfds.com", Namespace: "topics", Permission: "create", AccessType: "Capability", ObjectId: "cap-a"})
+	if decision.Permitted {
+		t.Errorf("permitted without the user's grants:\n%s", decision.Explain())
+	}
+	if !strings.Contains(strings.Join(decision.Notes, "\n"), "holds no direct user grants") {
+		t.Errorf("notes %q do not say user grants are missing", decision.Notes)
+	}
+}
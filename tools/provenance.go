@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Provenance
+
+Roles and groups the tool creates carry a marker at the end of their description, so it can tell its own
+objects from ones made in the portal. Pruning only revokes and deletes what the tool owns: objects with
+the marker, objects created before the marker existed (recognisable by the old description), and objects
+config.json adopts by pinning their existingId. Everything else is reported for manual review.
+
+This holds for restore as well: by default it does not revert roles and groups made outside the tool,
+even when they are not in the snapshot. `restore --all` prunes regardless of provenance.
+
+Grants have no description or metadata in the API, so a grant is owned when the role or group it hangs
+off is owned.
+*/
+
+const managedByMarker = "[managed-by:rbac-reconciler]"
+
+func managedDescription(kind, name string) string {
+	return fmt.Sprintf("Automatically created %s: %s %s", kind, name, managedByMarker)
+}
+
+func isManagedDescription(description string) bool {
+	return strings.Contains(description, managedByMarker) ||
+		strings.HasPrefix(description, "Automatically created role: ") ||
+		strings.HasPrefix(description, "Automatically created group: ")
+}
+
+// adoptedIds collects the existingIds config.json pins, which the tool manages even without a marker.
+func adoptedIds(config *Config) map[string]bool {
+	ids := map[string]bool{}
+	for _, role := range config.Roles {
+		if role.ExistingId != "" {
+			ids[strings.ToLower(role.ExistingId)] = true
+		}
+	}
+	for _, group := range resolveManagedGroups(config) {
+		if group.ExistingId != "" {
+			ids[strings.ToLower(group.ExistingId)] = true
+		}
+	}
+	return ids
+}
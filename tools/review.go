@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Access review
+
+A recertification sheet for the quarterly access review. Every row is one role a principal holds, with
+how they got it (a direct grant or membership of a group) and when they were last seen according to
+GET /rbac/members. The sheet has three parts:
+
+	group       every member of a group and the roles the group gives them
+	capability  every principal holding a role on a capability, directly or through a group
+	direct      Global roles granted to users directly instead of through a group
+
+Principals not seen within the inactivity threshold, never seen, or unknown to /rbac/members are flagged
+inactive so reviewers can start with them.
+*/
+
+const defaultInactiveDays = 90
+
+type ReviewRow struct {
+	Sheet         string // group, capability or direct
+	Subject       string // group name, capability ID or "Global"
+	Principal     string
+	DisplayName   string
+	PrincipalType string
+	Role          string
+	Scope         string
+	Via           string
+	LastSeen      string
+	Inactive      bool
+}
+
+type AccessReview struct {
+	ApiUrl       string
+	GeneratedAt  time.Time
+	InactiveDays int
+	Rows         []ReviewRow
+}
+
+func (r *AccessReview) inactiveCount() int {
+	principals := map[string]bool{}
+	for _, row := range r.Rows {
+		if row.Inactive {
+			principals[memberKey(row.Principal)] = true
+		}
+	}
+	return len(principals)
+}
+
+// ReviewFilter limits the sheet to some groups and capabilities. Without any filter everything is
+// reviewed; with one, only what it names.
+type ReviewFilter struct {
+	Groups       []string
+	Capabilities []string
+}
+
+func (f ReviewFilter) all() bool {
+	return len(f.Groups) == 0 && len(f.Capabilities) == 0
+}
+
+func (f ReviewFilter) includeGroup(name string) bool {
+	return f.all() || containsFold(f.Groups, name)
+}
+
+func (f ReviewFilter) includeCapability(id string) bool {
+	return f.all() || containsFold(f.Capabilities, id)
+}
+
+// lastSeen describes when a principal was last seen and whether that makes them inactive.
+func lastSeen(member *MemberSummary, now time.Time, inactiveDays int) (string, bool) {
+	switch {
+	case member == nil:
+		return "unknown principal", true
+	case member.LastSeen == nil:
+		return "never", true
+	}
+	inactive := now.Sub(*member.LastSeen) > time.Duration(inactiveDays)*24*time.Hour
+	return member.LastSeen.UTC().Format("2006-01-02"), inactive
+}
+
+func buildAccessReview(state *RbacState, members []MemberSummary, userGrants map[string][]RoleAssignment,
+	filter ReviewFilter, now time.Time, inactiveDays int) *AccessReview {
+	review := &AccessReview{ApiUrl: state.ApiUrl, GeneratedAt: now, InactiveDays: inactiveDays}
+
+	membersById := make(map[string]*MemberSummary, len(members))
+	for i := range members {
+		membersById[memberKey(members[i].Id)] = &members[i]
+	}
+	roleNames := make(map[string]string, len(state.Roles))
+	for _, role := range state.Roles {
+		roleNames[strings.ToLower(role.ID)] = role.Name
+	}
+
+	row := func(sheet, subject, principal, roleName string, grant RoleAssignment, via string) ReviewRow {
+		member := membersById[memberKey(principal)]
+		seen, inactive := lastSeen(member, now, inactiveDays)
+		r := ReviewRow{
+			Sheet:     sheet,
+			Subject:   subject,
+			Principal: principal,
+			Role:      roleName,
+			Scope:     grant.Type,
+			Via:       via,
+			LastSeen:  seen,
+			Inactive:  inactive,
+		}
+		if strings.EqualFold(grant.Type, "capability") {
+			r.Scope = fmt.Sprintf("Capability %s", grant.Resource)
+		}
+		if member != nil {
+			r.DisplayName, r.PrincipalType = member.DisplayName, member.Type
+		}
+		return r
+	}
+
+	for _, group := range state.Groups {
+		via := fmt.Sprintf("group '%s'", group.Name)
+		for _, member := range group.Members {
+			if filter.includeGroup(group.Name) {
+				if len(group.RoleGrants) == 0 {
+					// Membership alone may still grant group permissions, so it is reviewed too.
+					review.Rows = append(review.Rows, row("group", group.Name, member, "-", RoleAssignment{Type: "-"}, via))
+				}
+				for _, grant := range group.RoleGrants {
+					review.Rows = append(review.Rows, row("group", group.Name, member, grant.RoleName, grant.RoleAssignment, via))
+				}
+			}
+			for _, grant := range group.RoleGrants {
+				if strings.EqualFold(grant.Type, "capability") && filter.includeCapability(grant.Resource) {
+					review.Rows = append(review.Rows, row("capability", grant.Resource, member, grant.RoleName, grant.RoleAssignment, via))
+				}
+			}
+		}
+	}
+
+	for _, member := range members {
+		for _, grant := range userGrants[memberKey(member.Id)] {
+			roleName, known := roleNames[strings.ToLower(grant.RoleId)]
+			if !known {
+				roleName = grant.RoleId
+			}
+			switch {
+			case strings.EqualFold(grant.Type, "capability") && filter.includeCapability(grant.Resource):
+				review.Rows = append(review.Rows, row("capability", grant.Resource, member.Id, roleName, grant, "direct"))
+			case !strings.EqualFold(grant.Type, "capability") && filter.all():
+				review.Rows = append(review.Rows, row("direct", "Global", member.Id, roleName, grant, "direct"))
+			}
+		}
+	}
+
+	sheetOrder := map[string]int{"group": 0, "capability": 1, "direct": 2}
+	sort.SliceStable(review.Rows, func(i, j int) bool {
+		a, b := review.Rows[i], review.Rows[j]
+		if a.Sheet != b.Sheet {
+			return sheetOrder[a.Sheet] < sheetOrder[b.Sheet]
+		}
+		if a.Subject != b.Subject {
+			return strings.ToLower(a.Subject) < strings.ToLower(b.Subject)
+		}
+		if memberKey(a.Principal) != memberKey(b.Principal) {
+			return memberKey(a.Principal) < memberKey(b.Principal)
+		}
+		return a.Role < b.Role
+	})
+
+	return review
+}
+
+// userRoleGrants returns the direct role grants of every user in the state, keyed by member key.
+func userRoleGrants(state *RbacState) map[string][]RoleAssignment {
+	grants := make(map[string][]RoleAssignment, len(state.Users))
+	for _, user := range state.Users {
+		for _, grant := range user.RoleGrants {
+			grants[memberKey(user.ID)] = append(grants[memberKey(user.ID)], grant.RoleAssignment)
+		}
+	}
+	return grants
+}
+
+/*
+Output
+*/
+
+func inactiveMarker(inactive bool) string {
+	if inactive {
+		return "yes"
+	}
+	return ""
+}
+
+func writeReviewCSV(w io.Writer, review *AccessReview) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"sheet", "subject", "principal", "display name", "type", "role", "scope", "via", "last seen", "inactive"})
+	for _, row := range review.Rows {
+		out.Write([]string{row.Sheet, row.Subject, row.Principal, row.DisplayName, row.PrincipalType, row.Role, row.Scope, row.Via, row.LastSeen, inactiveMarker(row.Inactive)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+var reviewTemplate = template.Must(template.New("review").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Access review ({{.Review.ApiUrl}})</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+th { background: #f3f3f3; }
+tr.inactive td { background: #ffe0e0; }
+td.decision { width: 8em; }
+</style>
+</head>
+<body>
+<h1>Access review</h1>
+<p>Environment: {{.Review.ApiUrl}}. Generated {{.Review.GeneratedAt.Format "2006-01-02 15:04 MST"}}.
+Principals not seen for {{.Review.InactiveDays}} days are marked inactive ({{.Inactive}} found).</p>
+{{range .Sections}}<h2>{{.Sheet}}: {{.Subject}}</h2>
+<table>
+<thead><tr><th>Principal</th><th>Display name</th><th>Type</th><th>Role</th><th>Scope</th><th>Via</th><th>Last seen</th><th>Keep / remove</th></tr></thead>
+<tbody>
+{{range .Rows}}<tr{{if .Inactive}} class="inactive"{{end}}><td>{{.Principal}}</td><td>{{.DisplayName}}</td><td>{{.PrincipalType}}</td><td>{{.Role}}</td><td>{{.Scope}}</td><td>{{.Via}}</td><td>{{.LastSeen}}</td><td class="decision"></td></tr>
+{{end}}</tbody>
+</table>
+{{end}}</body>
+</html>
+`))
+
+func writeReviewHTML(w io.Writer, review *AccessReview) error {
+	type section struct {
+		Sheet   string
+		Subject string
+		Rows    []ReviewRow
+	}
+
+	var sections []section
+	for _, row := range review.Rows {
+		if len(sections) == 0 || sections[len(sections)-1].Sheet != row.Sheet || sections[len(sections)-1].Subject != row.Subject {
+			sections = append(sections, section{Sheet: row.Sheet, Subject: row.Subject})
+		}
+		sections[len(sections)-1].Rows = append(sections[len(sections)-1].Rows, row)
+	}
+
+	return reviewTemplate.Execute(w, struct {
+		Review   *AccessReview
+		Inactive int
+		Sections []section
+	}{review, review.inactiveCount(), sections})
+}
+
+/*
+Command
+*/
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func runReview(config *Config, args []string) {
+	flags := flag.NewFlagSet("review", flag.ExitOnError)
+	format := flags.String("format", "csv", "csv or html")
+	outPath := flags.String("out", "", "output file (default stdout)")
+	inactiveDays := flags.Int("inactive-days", defaultInactiveDays, "flag principals not seen for this many days")
+	groups := flags.String("groups", "", "comma-separated groups to review (default all)")
+	capabilities := flags.String("capabilities", "", "comma-separated capability IDs to review (default all)")
+	flags.Parse(args)
+
+	writers := map[string]func(io.Writer, *AccessReview) error{
+		"csv":  writeReviewCSV,
+		"html": writeReviewHTML,
+	}
+	write, known := writers[strings.ToLower(*format)]
+	if !known {
+		fatalf("unknown format '%s', expected csv or html", *format)
+	}
+
+	log.Printf(">> Collecting access review data from %s...", config.ApiUrl)
+	state, err := fetchState(config, false)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+	// The members are fetched once, for their last-seen data and for their direct grants.
+	members, err := fetchAllMembers(config)
+	if err != nil {
+		fatalf("failed to fetch members: %v", err)
+	}
+	if err := fetchUserGrants(config, state, members); err != nil {
+		fatalf("failed to fetch user grants: %v", err)
+	}
+	userGrants := userRoleGrants(state)
+
+	filter := ReviewFilter{Groups: splitList(*groups), Capabilities: splitList(*capabilities)}
+	review := buildAccessReview(state, members, userGrants, filter, time.Now().UTC(), *inactiveDays)
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fatalf("failed to create '%s': %v", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := write(out, review); err != nil {
+		fatalf("failed to write access review: %v", err)
+	}
+	log.Printf("<< Access review with %d row(s) written, %d inactive principal(s) flagged.", len(review.Rows), review.inactiveCount())
+}
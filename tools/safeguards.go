@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+/*
+Safeguards
+
+Limits on how much a single run may change, and objects no run may take rights away from. They are
+checked against everything a run is about to change, before the first write, so a bad config.json aborts
+the run instead of half-applying: in applyPlan for sync, restore, apply and team-links, and on the
+reversals and merges planned by rollback and duplicates --merge. Limits of 0 mean no limit.
+
+	"safeguards": {
+	    "maxGrants": 0,
+	    "maxRevocations": 25,
+	    "maxMemberRemovals": 10,
+	    "protectedRoles": ["CloudEngineer"],
+	    "protectedGroups": ["CloudEngineers"],
+	    "protectedPrincipals": [],
+	    "allowExpiryOnProtected": false
+	}
+
+A member whose expiry date has passed is removed even if they are a protected principal, since config.json
+itself asks for it. Expired access in protected groups and roles stays protected unless
+allowExpiryOnProtected is set, so a date typed into config.json cannot strip them unnoticed. Expired
+removals count towards the limits either way.
+*/
+
+type Safeguards struct {
+	MaxGrants           int      `json:"maxGrants"`
+	MaxRevocations      int      `json:"maxRevocations"`
+	MaxMemberRemovals   int      `json:"maxMemberRemovals"`
+	ProtectedRoles      []string `json:"protectedRoles"`
+	ProtectedGroups     []string `json:"protectedGroups"`
+	ProtectedPrincipals []string `json:"protectedPrincipals"`
+
+	AllowExpiryOnProtected bool `json:"allowExpiryOnProtected"`
+}
+
+func isGrantAction(action string) bool {
+	switch action {
+	case "create-role", "create-group", "grant-permission", "grant-role", "add-member":
+		return true
+	}
+	return false
+}
+
+func isRevocationAction(action string) bool {
+	switch action {
+	case "revoke-permission", "revoke-role", "delete-group", "delete-role":
+		return true
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// protectedTarget names the protected object a change takes rights away from, or returns "".
+func protectedTarget(safeguards Safeguards, change Change) string {
+	if !isRevocationAction(change.Action) && change.Action != "remove-member" {
+		return ""
+	}
+	if change.Expired && safeguards.AllowExpiryOnProtected {
+		return ""
+	}
+
+	if change.Action == "remove-member" && !change.Expired && containsFold(safeguards.ProtectedPrincipals, change.Member) {
+		return fmt.Sprintf("principal '%s'", change.Member)
+	}
+	if change.User != "" && containsFold(safeguards.ProtectedPrincipals, change.User) {
+		return fmt.Sprintf("principal '%s'", change.User)
+	}
+	if change.GroupName != "" && containsFold(safeguards.ProtectedGroups, change.GroupName) {
+		return fmt.Sprintf("group '%s'", change.GroupName)
+	}
+	// A role grant revoked from a group takes the role away too, so the role name counts either way.
+	if change.RoleName != "" && containsFold(safeguards.ProtectedRoles, change.RoleName) {
+		return fmt.Sprintf("role '%s'", change.RoleName)
+	}
+	return ""
+}
+
+// checkSafeguards returns every way the plan breaks the configured safeguards.
+func checkSafeguards(config *Config, plan *Plan) []string {
+	safeguards := config.Safeguards
+
+	grants, revocations, removals := 0, 0, 0
+	var violations []string
+	for _, change := range plan.Changes {
+		switch {
+		case isGrantAction(change.Action):
+			grants++
+		case isRevocationAction(change.Action):
+			revocations++
+		case change.Action == "remove-member":
+			removals++
+		}
+		if target := protectedTarget(safeguards, change); target != "" {
+			violations = append(violations, fmt.Sprintf("%s is protected: %s", target, change))
+		}
+	}
+
+	limits := []struct {
+		name  string
+		count int
+		max   int
+	}{
+		{"grants", grants, safeguards.MaxGrants},
+		{"revocations", revocations, safeguards.MaxRevocations},
+		{"member removals", removals, safeguards.MaxMemberRemovals},
+	}
+	for _, limit := range limits {
+		if limit.max > 0 && limit.count > limit.max {
+			violations = append(violations, fmt.Sprintf("%d %s planned, the limit per run is %d", limit.count, limit.name, limit.max))
+		}
+	}
+
+	return violations
+}
+
+// enforceSafeguards stops the run before the first write if the plan breaks any safeguard.
+func enforceSafeguards(config *Config, plan *Plan) {
+	violations := checkSafeguards(config, plan)
+	if len(violations) == 0 {
+		return
+	}
+	logPlanSummary(plan)
+	for _, violation := range violations {
+		log.Printf("- ERROR: %s", violation)
+	}
+	fatalf("aborted before the first write: the plan breaks %d safeguard(s) in config.json", len(violations))
+}
+
+// logPlanSummary prints how many changes of each kind a plan holds.
+func logPlanSummary(plan *Plan) {
+	counts := map[string]int{}
+	for _, change := range plan.Changes {
+		counts[change.Action]++
+	}
+	actions := make([]string, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return changeOrder[actions[i]] < changeOrder[actions[j]] })
+
+	log.Printf("The run wanted to make %d change(s):", len(plan.Changes))
+	for _, action := range actions {
+		log.Printf("  %-18s %d", action, counts[action])
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckSafeguards(t *testing.T) {
+	protected := Safeguards{
+		ProtectedRoles:      []string{"CloudEngineer"},
+		ProtectedGroups:     []string{"CloudEngineers"},
+		ProtectedPrincipals: []string{"admin@dfds.com"},
+	}
+
+	tests := []struct {
+		name       string
+		safeguards Safeguards
+		changes    []Change
+		want       []string
+	}{
+		{
+			name:       "grants never touch protected objects",
+			safeguards: protected,
+			changes: []Change{
+				{Action: "grant-role", GroupName: "CloudEngineers", RoleName: "CloudEngineer", Type: "Global"},
+				{Action: "add-member", GroupName: "CloudEngineers", Member: "admin@dfds.com"},
+			},
+		},
+		{
+			name:       "revocations from protected groups, roles and principals are refused",
+			safeguards: protected,
+			changes: []Change{
+				{Action: "revoke-role", GroupName: "cloudengineers", RoleName: "Reader", Type: "Global"},
+				{Action: "revoke-permission", RoleName: "CloudEngineer", Namespace: "rbac", Permission: "read", Type: "Global"},
+				{Action: "remove-member", GroupName: "Readers", Member: "Admin@dfds.com"},
+				{Action: "revoke-role", User: "admin@dfds.com", RoleName: "Owner", Type: "Capability", Resource: "cap-a"},
+			},
+			want: []string{
+				"group 'cloudengineers' is protected: revoke role 'Reader' (Global) from group 'cloudengineers'",
+				"role 'CloudEngineer' is protected: revoke permission 'rbac/read' (Global) from role 'CloudEngineer'",
+				"principal 'Admin@dfds.com' is protected: remove member 'Admin@dfds.com' from group 'Readers'",
+				"principal 'admin@dfds.com' is protected: revoke role 'Owner' (Capability cap-a) from user 'admin@dfds.com'",
+			},
+		},
+		{
+			name:       "expired members are removed even when they are protected principals",
+			safeguards: protected,
+			changes:    []Change{{Action: "remove-member", GroupName: "Readers", Member: "admin@dfds.com", Expired: true}},
+		},
+		{
+			name:       "expired access in protected groups and roles stays protected",
+			safeguards: protected,
+			changes: []Change{
+				{Action: "remove-member", GroupName: "CloudEngineers", Member: "contractor@dfds.com", Expired: true},
+				{Action: "revoke-role", GroupName: "Readers", RoleName: "CloudEngineer", Type: "Global", Expired: true},
+			},
+			want: []string{
+				"group 'CloudEngineers' is protected: remove member 'contractor@dfds.com' from group 'CloudEngineers'",
+				"role 'CloudEngineer' is protected: revoke role 'CloudEngineer' (Global) from group 'Readers'",
+			},
+		},
+		{
+			name: "allowExpiryOnProtected lets expired access go",
+			safeguards: Safeguards{
+				ProtectedGroups:        []string{"CloudEngineers"},
+				AllowExpiryOnProtected: true,
+			},
+			changes: []Change{{Action: "remove-member", GroupName: "CloudEngineers", Member: "contractor@dfds.com", Expired: true}},
+		},
+		{
+			name:       "limits count each kind of change, expired ones included",
+			safeguards: Safeguards{MaxGrants: 1, MaxRevocations: 1, MaxMemberRemovals: 1},
+			changes: []Change{
+				{Action: "create-role", RoleName: "A"},
+				{Action: "grant-role", GroupName: "G", RoleName: "A", Type: "Global"},
+				{Action: "revoke-role", GroupName: "G", RoleName: "B", Type: "Global"},
+				{Action: "remove-member", GroupName: "G", Member: "a@dfds.com", Expired: true},
+				{Action: "remove-member", GroupName: "G", Member: "b@dfds.com"},
+			},
+			want: []string{
+				"2 grants planned, the limit per run is 1",
+				"2 member removals planned, the limit per run is 1",
+			},
+		},
+		{
+			name:       "limits of 0 mean no limit",
+			safeguards: Safeguards{},
+			changes: []Change{
+				{Action: "delete-role", RoleName: "A", ObjectId: "r1"},
+				{Action: "delete-group", GroupName: "G", ObjectId: "g1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Safeguards: test.safeguards}
+			got := checkSafeguards(config, &Plan{Changes: test.changes})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("violations:\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
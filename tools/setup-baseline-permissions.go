@@ -9,185 +9,214 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 func main() {
 	const configPath = "config.json"
 
-	log.Println(">> Starting baseline permissions setup...")
-
-	config, err := loadConfig(configPath)
-	if err != nil {
-		panic(err)
-	}
-
-	if config.Debug {
-		log.Println("Configuration loaded:")
-		log.Printf(" - API URL: %s", config.ApiUrl)
+	command := "sync"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
 	}
 
-	if config.Debug {
-		log.Println("...")
-	}
+	// Commands that can run offline ask for the access token themselves when they need the API.
+	offlineCommands := map[string]bool{"matrix": true, "graph": true, "explain": true, "lint": true, "diff": true}
 
-	/*
-	  Fetch available roles
-	  Check that required roles exist
-	  if not, create them
-	*/
-	if config.Debug {
-		log.Println(">> Consolidating roles list...")
-	}
-
-	availableRoles, err := fetchRoles(config)
+	config, err := loadConfigFile(configPath)
 	if err != nil {
-		log.Fatalf("failed to fetch roles: %v", err)
+		panic(err)
 	}
-
-	for _, role := range config.Roles {
-		if shouldSkipRole(role.Name) {
-			if config.Debug {
-				log.Printf("Skipping role '%s' in baseline sync (managed implicitly by API semantics).", role.Name)
-			}
-			continue
-		}
-		if _, exists := availableRoles[strings.ToLower(role.Name)]; !exists {
-			log.Printf("required role '%s' does not exist in the system; creating it...", role)
-			createRole(config, role)
+	if !offlineCommands[command] {
+		if err := readAccessToken(config); err != nil {
+			panic(err)
 		}
 	}
 
-	//check for roles that exist in the system but are not in config and warn about them
-	for name := range availableRoles {
-		found := false
-		for _, role := range config.Roles {
-			if shouldSkipRole(role.Name) {
-				continue
-			}
-			if strings.EqualFold(name, role.Name) {
-				found = true
-				break
-			}
+	switch command {
+	case "sync":
+		if !runLint(config) {
+			os.Exit(1)
 		}
-		if !found {
-			log.Printf("- WARNING: role '%s' exists in the system but is not defined in config.json. Please review manually.", name)
+		startRun(config)
+		runBaselineSync(config)
+		finishRun(config)
+		if config.AssertionsPath != "" && !runVerify(config, config.AssertionsPath) {
+			os.Exit(1)
 		}
-	}
-
-	availableRoles, err = fetchRoles(config)
-	if err != nil {
-		log.Fatalf("failed to fetch roles: %v", err)
-	}
-	// Debug: sanity check - fetch roles again and print them
-	if config.Debug {
-		log.Println("All required roles should now exist:")
-		for name, id := range availableRoles {
-			log.Printf(" - %s (ID: %s)", name, id)
+	case "rollback":
+		if len(os.Args) < 3 {
+			fatalf("usage: rollback <run-id>")
 		}
-	}
-
-	if config.Debug {
-		log.Println("...")
-	}
-
-	/*
-	  For each role in config, fetch permissions
-	  Verify that permissions match expected permissions for that role in config
-	  If not, update permissions to match expected permissions
-	  Warn about existing permissions for a role not matching expected permissions
-	*/
-
-	for _, role := range config.Roles {
-		if shouldSkipRole(role.Name) {
-			if config.Debug {
-				log.Printf(">> Skipping permissions verification for role: %s", role.Name)
-			}
-			continue
+		startRun(config)
+		defer finishRun(config)
+		runRollback(config, os.Args[2])
+	case "snapshot":
+		runSnapshot(config)
+	case "unlock":
+		runUnlock(config)
+	case "duplicates":
+		if len(os.Args) > 2 && os.Args[2] == "--merge" {
+			startRun(config)
+			defer finishRun(config)
+			runDuplicates(config, true)
+		} else {
+			runDuplicates(config, false)
 		}
-
-		if config.Debug {
-			log.Printf(">> Verifying permissions for role: %s", role.Name)
+	case "restore":
+		if len(os.Args) < 3 {
+			fatalf("usage: restore [--all] <snapshot>")
 		}
-
-		roleId, exists := availableRoles[strings.ToLower(role.Name)]
-		if !exists {
-			log.Fatalf("role '%s' not found in available roles after creation step", role.Name)
+		startRun(config)
+		defer finishRun(config)
+		runRestore(config, os.Args[2:])
+	case "matrix":
+		runMatrix(config, os.Args[2:])
+	case "graph":
+		runGraph(config, os.Args[2:])
+	case "explain":
+		runExplain(config, os.Args[2:])
+	case "lint":
+		if len(os.Args) > 2 && os.Args[2] == "--rules" {
+			printLintRules(config)
+			return
 		}
-
-		permissions, err := fetchPermissionsForRole(config, roleId)
-		if err != nil {
-			log.Fatalf("failed to fetch permissions for role '%s': %v", role.Name, err)
+		if !runLint(config) {
+			os.Exit(1)
 		}
-
-		normalizedExpected := normalizePermissionMap(role.Permissions)
-		normalizedExisting := normalizePermissionMap(permissions)
-
-		for namespace, existingPerms := range normalizedExisting {
-			if _, ok := normalizedExpected[namespace]; !ok {
-				log.Printf("- WARNING: role '%s' has unexpected namespace '%s' with permissions %v. Please review manually.", role.Name, namespace, existingPerms)
-			}
+	case "diff":
+		if !runDiff(os.Args[2:]) {
+			os.Exit(1)
 		}
-
-		for namespace, expectedPerms := range normalizedExpected {
-			existingPerms := normalizedExisting[namespace]
-			extraPermissions, missingPermissions := differences(existingPerms, expectedPerms)
-			for _, p := range extraPermissions {
-				log.Printf("- WARNING: role '%s' has unexpected permission '%s' in namespace '%s'. Please review manually.", role.Name, p, namespace)
-			}
-			for _, p := range missingPermissions {
-				if err := grantPermission(config, "Role", roleId, namespace, p); err != nil {
-					log.Fatalf(
-						"failed to grant missing permission for role '%s' (roleId='%s', namespace='%s', permission='%s'): %v",
-						role.Name,
-						roleId,
-						namespace,
-						p,
-						err,
-					)
-				}
-			}
+	case "plan":
+		outPath := defaultPlanPath
+		if len(os.Args) > 2 {
+			outPath = os.Args[2]
+		}
+		if !runLint(config) {
+			os.Exit(1)
+		}
+		runPlan(config, configPath, outPath)
+	case "apply":
+		if len(os.Args) < 3 {
+			fatalf("usage: apply <planfile>")
+		}
+		planFile := loadApprovedPlan(config, configPath, os.Args[2])
+		startRun(config)
+		defer finishRun(config)
+		runApply(config, planFile, os.Args[2])
+	case "review":
+		runReview(config, os.Args[2:])
+	case "team-links":
+		runTeamLinks(config, os.Args[2:])
+	case "verify":
+		path := defaultAssertionsPath
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		if !runVerify(config, path) {
+			os.Exit(1)
 		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: go run *.go [command]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  sync               reconcile roles, permissions and groups with config.json (default)")
+	fmt.Fprintln(os.Stderr, "  plan [file]        save the sync changes to a plan file (default rbac-plan.json) for review")
+	fmt.Fprintln(os.Stderr, "  apply <planfile>   apply a saved plan, refusing if it, config.json or the live state changed")
+	fmt.Fprintln(os.Stderr, "  rollback <run-id>  reverse every change journaled by the given run")
+	fmt.Fprintln(os.Stderr, "  snapshot           capture the complete RBAC state into a timestamped snapshot file")
+	fmt.Fprintln(os.Stderr, "  restore <snapshot> reconcile the environment back to a snapshot, pruning what the tool made that is not in it")
+	fmt.Fprintln(os.Stderr, "    --all            also prune roles, groups and grants made outside the tool")
+	fmt.Fprintln(os.Stderr, "  unlock             break the run lock left behind by a crashed run")
+	fmt.Fprintln(os.Stderr, "  duplicates         report roles and groups whose names differ only in case or whitespace")
+	fmt.Fprintln(os.Stderr, "    --merge          interactively move grants onto the canonical ID and delete the duplicates")
+	fmt.Fprintln(os.Stderr, "  matrix             export the role x permission matrix built from config.json")
+	fmt.Fprintln(os.Stderr, "    --live           build the matrix from the live environment instead")
+	fmt.Fprintln(os.Stderr, "    --format <fmt>   markdown (default), csv or html")
+	fmt.Fprintln(os.Stderr, "    --out <file>     write to a file instead of stdout")
+	fmt.Fprintln(os.Stderr, "  graph              draw groups, role bindings, roles and namespaces from config.json")
+	fmt.Fprintln(os.Stderr, "    --live           draw the live environment instead")
+	fmt.Fprintln(os.Stderr, "    --format <fmt>   mermaid (default) or dot")
+	fmt.Fprintln(os.Stderr, "    --members        include group members")
+	fmt.Fprintln(os.Stderr, "    --out <file>     write to a file instead of stdout")
+	fmt.Fprintln(os.Stderr, "  explain [flags] <principal> <namespace> <permission>")
+	fmt.Fprintln(os.Stderr, "                     evaluate a permission offline the way can-they does and show the grant paths")
+	fmt.Fprintln(os.Stderr, "    --snapshot <f>   evaluate against a snapshot instead of config.json")
+	fmt.Fprintln(os.Stderr, "    --live           evaluate against the live environment, including direct user grants")
+	fmt.Fprintln(os.Stderr, "    --object <id>    object the permission is checked on")
+	fmt.Fprintln(os.Stderr, "    --access-type    Global or Capability, when the catalogue is unavailable")
+	fmt.Fprintln(os.Stderr, "    --cases <file>   check the engine against the policy cases in a file, e.g. policy-cases.json")
+	fmt.Fprintln(os.Stderr, "  lint               check config.json against the policy lint rules, without calling the API")
+	fmt.Fprintln(os.Stderr, "    --rules          list the rules and their effective severity")
+	fmt.Fprintln(os.Stderr, "  diff [flags] <a> <b>")
+	fmt.Fprintln(os.Stderr, "                     compare two sources (config:<file>, snapshot:<file> or an API URL) by name")
+	fmt.Fprintln(os.Stderr, "    --members        include group members")
+	fmt.Fprintln(os.Stderr, "    --token-a <var>  environment variable with the token for a live source a (same for --token-b)")
+	fmt.Fprintln(os.Stderr, "  verify [file]      check access assertions (default assertions.json) through can-they")
+	fmt.Fprintln(os.Stderr, "  review             export a per-group and per-capability access review sheet with last-seen dates")
+	fmt.Fprintln(os.Stderr, "    --format <fmt>   csv (default) or html")
+	fmt.Fprintln(os.Stderr, "    --inactive-days  flag principals not seen for this many days (default 90)")
+	fmt.Fprintln(os.Stderr, "    --groups <list>  only review these comma-separated groups (same for --capabilities)")
+	fmt.Fprintln(os.Stderr, "    --out <file>     write to a file instead of stdout")
+	fmt.Fprintln(os.Stderr, "  team-links         grant the groups mapped in teamLinks a role on their team's linked capabilities")
+	fmt.Fprintln(os.Stderr, "    --dry-run        only print the grants and revocations")
+}
+
+func runBaselineSync(config *Config) {
+	log.Println(">> Starting baseline permissions setup...")
+
+	if config.Debug {
+		log.Println("Configuration loaded:")
+		log.Printf(" - API URL: %s", config.ApiUrl)
 	}
 
 	if config.Debug {
 		log.Println("...")
 	}
 
+	/*
+	  Fetch the live RBAC state (roles, permissions, groups, role grants)
+	  Diff it against the state described by config.json
+	  Create missing roles and groups, grant missing permissions and role bindings
+	  Warn about anything that exists in the system but not in config
+	*/
 	if config.Debug {
-		log.Println(">> Consolidating groups...")
+		log.Println(">> Fetching live RBAC state...")
 	}
 
-	managedGroups := resolveManagedGroups(config)
-
-	availableGroups, err := fetchGroups(config)
+	live, err := fetchState(config, false)
 	if err != nil {
-		log.Fatalf("failed to fetch groups: %v", err)
-	}
-
-	for _, groupSpec := range managedGroups {
-		if _, exists := availableGroups[groupSpec.Name]; !exists {
-			log.Printf("Group '%s' does not exist; creating it...", groupSpec.Name)
-			createGroup(config, groupSpec.Name)
-		}
+		fatalf("failed to fetch RBAC state: %v", err)
 	}
 
-	availableGroups, err = fetchGroups(config)
-	if err != nil {
-		log.Fatalf("failed to fetch groups: %v", err)
-	}
+	plan := computeBaselinePlan(config, live)
+	plan.LogWarnings()
 
-	if config.Debug {
-		log.Println("Now Available groups:")
-		for name, group := range availableGroups {
-			log.Printf(" - %s (ID: %s)", name, group.ID)
+	var applied []Change
+	if len(plan.Changes) == 0 {
+		log.Println("No changes required.")
+	} else {
+		snapshotPath, err := saveSnapshot(config, live)
+		if err != nil {
+			fatalf("failed to write pre-apply snapshot: %v", err)
 		}
+		log.Printf("Pre-apply snapshot written to '%s'.", snapshotPath)
+
+		applyPlan(config, plan)
+		applied = plan.Changes
 	}
 
-	for _, groupSpec := range managedGroups {
-		ensureGroupRoles(config, groupSpec, availableGroups, availableRoles)
-		//ensureGroupMembers(config, groupSpec, availableGroups)
-		log.Printf("Skipping member synchronization for group '%s' (members are managed manually).", groupSpec.Name)
+	for _, groupSpec := range resolveManagedGroups(config) {
+		log.Printf("Skipping member synchronization for group '%s' (members are managed manually, expired members are removed).", groupSpec.Name)
 	}
+	logExpiryReport(config, applied, time.Now().UTC())
 
 	if config.Debug {
 		log.Println("...")
@@ -196,6 +225,17 @@ func main() {
 	log.Println("<< Baseline permissions setup completed.")
 }
 
+// computeBaselinePlan is the diff the baseline sync applies; the plan command saves the same diff to a file.
+func computeBaselinePlan(config *Config, live *RbacState) *Plan {
+	return computePlan(desiredStateFromConfig(config), live, PlanOptions{
+		SkipRole:                  shouldSkipRole,
+		GlobalRolePermissionsOnly: true,
+		KeepGroupGrant: func(groupName string, grant StateRoleGrant) bool {
+			return isTeamLinkGrant(config, groupName, grant)
+		},
+	})
+}
+
 /**
  **
  **
@@ -212,41 +252,60 @@ Loading configuration
 
 type Role struct {
 	Name        string              `json:"name"`
+	ExistingId  string              `json:"existingId"`
+	Type        string              `json:"type,omitempty"` // defaults to 'Global'
 	Permissions map[string][]string `json:"permissions"`
 }
 
 type RoleBinding struct {
-	RoleName string `json:"roleName"`
-	Scope    string `json:"scope"`
+	RoleName string      `json:"roleName"`
+	Scope    string      `json:"scope"`
+	Expires  *ExpiryDate `json:"expires,omitempty"`
 }
 
 type ManagedGroup struct {
-	Name    string
-	Roles   []RoleBinding
-	Members []string
+	Name       string
+	ExistingId string
+	Roles      []RoleBinding
+	Members    []GroupMember
 }
 
 type ManagedGroupConfig struct {
-	Name    string        `json:"name"`
-	Roles   []RoleBinding `json:"roles"`
-	Members []string      `json:"members"`
+	Name       string        `json:"name"`
+	ExistingId string        `json:"existingId"`
+	Roles      []RoleBinding `json:"roles"`
+	Members    []GroupMember `json:"members"`
 }
 
 type Config struct {
-	Debug                   bool          `json:"debug"`
-	ApiUrl                  string        `json:"apiUrl"`
+	Debug                   bool                 `json:"debug"`
+	ApiUrl                  string               `json:"apiUrl"`
 	Groups                  []ManagedGroupConfig `json:"groups"`
-	Cloudengineers          []string      `json:"cloudengineers"`
-	BatchCapabilityCreators []string      `json:"batchCapabilityCreators"`
-	ServiceCatalogueReaders []string      `json:"serviceCatalogueReaders"`
-	CloudEngineerRoles      []RoleBinding `json:"cloudengineerRoles"`
-	AccessToken string // not from config, set from env var 'SELF_SERVICE_API_TOKEN'
-	Roles       []Role `json:"roles"`
-}
-
-func loadConfig(path string) (*Config, error) {
-	const accessTokenEnvVar = "SELF_SERVICE_API_TOKEN"
-
+	Cloudengineers          []GroupMember        `json:"cloudengineers"`
+	BatchCapabilityCreators []GroupMember        `json:"batchCapabilityCreators"`
+	ServiceCatalogueReaders []GroupMember        `json:"serviceCatalogueReaders"`
+	CloudEngineerRoles      []RoleBinding        `json:"cloudengineerRoles"`
+	JournalPath             string               `json:"journalPath"` // defaults to 'rbac-journal.jsonl'
+	SnapshotDir             string               `json:"snapshotDir"` // defaults to 'snapshots'
+	LockPath                string               `json:"lockPath"`    // defaults to '.rbac-reconciler.lock'
+	LockTtlMinutes          int                  `json:"lockTtlMinutes"`
+	AssertionsPath          string               `json:"assertionsPath"` // when set, sync runs verify afterwards
+	LintRules               map[string]string    `json:"lintRules"`      // rule ID -> error, warning or off
+	Safeguards              Safeguards           `json:"safeguards"`
+	ExpiryWarningDays       int                  `json:"expiryWarningDays"` // defaults to 14
+	AccessToken             string               // not from config, set from env var 'SELF_SERVICE_API_TOKEN'
+	Roles                   []Role               `json:"roles"`
+	TeamLinks               []TeamLinkMapping    `json:"teamLinks"` // see teamlinks.go
+
+	// Per-run state, set by startRun
+	RunId    string
+	Operator string
+	Journal  *Journal
+}
+
+// loadConfigFile reads the configuration without requiring an access token, for commands that can
+// work from config.json alone.
+func loadConfigFile(path string) (*Config, error) {
 	file, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -257,14 +316,20 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	return &cfg, nil
+}
+
+func readAccessToken(cfg *Config) error {
+	const accessTokenEnvVar = "SELF_SERVICE_API_TOKEN"
+
 	// read token from environment variable
 	token := os.Getenv(accessTokenEnvVar)
 	if token == "" {
-		return nil, fmt.Errorf("environment variable %s is not set", accessTokenEnvVar)
+		return fmt.Errorf("environment variable %s is not set", accessTokenEnvVar)
 	}
 	cfg.AccessToken = token
 
-	return &cfg, nil
+	return nil
 }
 
 /*
@@ -277,6 +342,7 @@ type Capability struct {
 }
 
 type RoleAssignment struct {
+	ID                 string `json:"id,omitempty"`
 	RoleId             string `json:"roleId"`
 	AssignedEntityType string `json:"assignedEntityType"`
 	AssignedEntityId   string `json:"assignedEntityId"`
@@ -285,10 +351,13 @@ type RoleAssignment struct {
 }
 
 type PermissionGrant struct {
-	Namespace  string `json:"namespace"`
-	Permission string `json:"permission"`
-	Type       string `json:"type"`
-	Resource   string `json:"resource"`
+	ID                 string `json:"id,omitempty"`
+	Namespace          string `json:"namespace"`
+	Permission         string `json:"permission"`
+	Type               string `json:"type"`
+	Resource           string `json:"resource"`
+	AssignedEntityType string `json:"assignedEntityType,omitempty"`
+	AssignedEntityId   string `json:"assignedEntityId,omitempty"`
 }
 
 type PermissionGrantCreation struct {
@@ -301,9 +370,10 @@ type PermissionGrantCreation struct {
 }
 
 type SystemRole struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
 }
 
 type Member struct {
@@ -311,10 +381,19 @@ type Member struct {
 	//GroupId string `json:"groupId"`
 }
 
+type MemberSummary struct {
+	Id          string     `json:"id"`
+	Email       string     `json:"email"`
+	DisplayName string     `json:"displayName"`
+	Type        string     `json:"type"`
+	LastSeen    *time.Time `json:"lastSeen"`
+}
+
 type Group struct {
-	ID      string   `json:"id"`
-	Name    string   `json:"name"`
-	Members []Member `json:"members"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []Member `json:"members"`
 }
 
 /*
@@ -322,6 +401,25 @@ type Group struct {
 */
 
 func fetchRoles(config *Config) (map[string]string, error) {
+	roles, err := fetchRoleList(config)
+	if err != nil {
+		return nil, err
+	}
+
+	availableRoles := make(map[string]string)
+	for _, role := range roles {
+		key := strings.ToLower(role.Name)
+		if existing, duplicate := availableRoles[key]; duplicate {
+			log.Printf("- WARNING: roles '%s' and '%s' share the name '%s'; using '%s'. Run 'duplicates' to resolve.", existing, role.ID, role.Name, existing)
+			continue
+		}
+		availableRoles[key] = role.ID
+	}
+
+	return availableRoles, nil
+}
+
+func fetchRoleList(config *Config) ([]SystemRole, error) {
 	url := fmt.Sprintf("%s/rbac/get-assignable-roles", config.ApiUrl)
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
@@ -345,21 +443,21 @@ func fetchRoles(config *Config) (map[string]string, error) {
 		return nil, err
 	}
 
-	availableRoles := make(map[string]string)
-	for _, role := range roles {
-		availableRoles[strings.ToLower(role.Name)] = role.ID
-	}
-
-	return availableRoles, nil
+	return roles, nil
 }
 
-func createRole(config *Config, role Role) {
+func createRole(config *Config, role Role) string {
 	url := fmt.Sprintf("%s/rbac/role", config.ApiUrl)
 
+	roleType := role.Type
+	if roleType == "" {
+		roleType = "Global"
+	}
+
 	payload := map[string]string{
 		"name":        role.Name,
-		"description": fmt.Sprintf("Automatically created role: %s", role.Name),
-		"type":        "Global",
+		"description": managedDescription("role", role.Name),
+		"type":        roleType,
 	}
 	body, _ := json.Marshal(payload)
 
@@ -370,16 +468,42 @@ func createRole(config *Config, role Role) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failed to create role: %v", err)
+		fatalf("failed to create role: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Fatalf("failed to create role, [error code %d]", resp.StatusCode)
+		fatalf("failed to create role, [error code %d]", resp.StatusCode)
+	}
+
+	var created SystemRole
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Printf("failed to decode created role response: %v", err)
 	}
+	config.Journal.Record("create-role", payload, "Role", created.ID)
+
+	return created.ID
 }
 
 func fetchGroups(config *Config) (map[string]Group, error) {
+	groups, err := fetchGroupList(config)
+	if err != nil {
+		return nil, err
+	}
+
+	availableGroups := make(map[string]Group)
+	for _, group := range groups {
+		if existing, duplicate := availableGroups[group.Name]; duplicate {
+			log.Printf("- WARNING: groups '%s' and '%s' share the name '%s'; using '%s'. Run 'duplicates' to resolve.", existing.ID, group.ID, group.Name, existing.ID)
+			continue
+		}
+		availableGroups[group.Name] = group
+	}
+
+	return availableGroups, nil
+}
+
+func fetchGroupList(config *Config) ([]Group, error) {
 	url := fmt.Sprintf("%s/rbac/groups", config.ApiUrl)
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
@@ -403,19 +527,18 @@ func fetchGroups(config *Config) (map[string]Group, error) {
 		return nil, err
 	}
 
-	availableGroups := make(map[string]Group)
-	for _, group := range groups {
-		availableGroups[group.Name] = group
-	}
+	return groups, nil
+}
 
-	return availableGroups, nil
+func createGroup(config *Config, groupName string) string {
+	return createGroupWithDescription(config, groupName, managedDescription("group", groupName))
 }
 
-func createGroup(config *Config, groupName string) {
+func createGroupWithDescription(config *Config, groupName, description string) string {
 	url := fmt.Sprintf("%s/rbac/groups", config.ApiUrl)
 	payload := map[string]string{
 		"name":        groupName,
-		"description": fmt.Sprintf("Automatically created group: %s", groupName),
+		"description": description,
 	}
 	body, _ := json.Marshal(payload)
 
@@ -426,16 +549,24 @@ func createGroup(config *Config, groupName string) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failed to create group: %v", err)
+		fatalf("failed to create group: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Fatalf("failed to create group, [error code %d]", resp.StatusCode)
+		fatalf("failed to create group, [error code %d]", resp.StatusCode)
+	}
+
+	var created Group
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		log.Printf("failed to decode created group response: %v", err)
 	}
+	config.Journal.Record("create-group", payload, "Group", created.ID)
+
+	return created.ID
 }
 
-func createMembership(config *Config, groupID, email string) {
+func createMembership(config *Config, groupID, email string) error {
 	url := fmt.Sprintf("%s/rbac/groups/%s/members", config.ApiUrl, groupID)
 	payload := map[string]string{
 		"userId":  email,
@@ -450,16 +581,19 @@ func createMembership(config *Config, groupID, email string) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failed to create membership: %v", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Fatalf("failed to create membership, [error code %d]", resp.StatusCode)
+		return fmt.Errorf("failed to create membership, [error code %d]", resp.StatusCode)
 	}
+	config.Journal.Record("add-member", payload, "Member", groupID+"/"+email)
+
+	return nil
 }
 
-func removeMembership(config *Config, groupID, memberId string) {
+func removeMembership(config *Config, groupID, memberId string) error {
 	url := fmt.Sprintf("%s/rbac/groups/%s/members/%s", config.ApiUrl, groupID, memberId)
 	req, _ := http.NewRequest("DELETE", url, nil)
 	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
@@ -467,13 +601,16 @@ func removeMembership(config *Config, groupID, memberId string) {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failed to remove membership: %v", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		log.Fatalf("failed to remove membership, [error code %d]", resp.StatusCode)
+		return fmt.Errorf("failed to remove membership, [error code %d]", resp.StatusCode)
 	}
+	config.Journal.Record("remove-member", map[string]string{"userId": memberId, "groupId": groupID}, "Member", groupID+"/"+memberId)
+
+	return nil
 }
 
 func assignRole(config *Config, roleId, assignedEntityType, assignedEntityId, assignmentType, resource string) error {
@@ -505,9 +642,60 @@ func assignRole(config *Config, roleId, assignedEntityType, assignedEntityId, as
 		return fmt.Errorf("failed to assign role: %s, [error code %d]", string(b), resp.StatusCode)
 	}
 
+	// The grant endpoint does not return the created grant, so look it up for the journal, if there is one.
+	// If that fails, a rollback looks the grant up again from the journaled request.
+	if config.Journal != nil {
+		grantId, err := lookupRoleGrantId(config, payload)
+		if err != nil {
+			log.Printf("- WARNING: could not resolve ID of new role grant for %s '%s', a rollback will look it up: %v", assignedEntityType, assignedEntityId, err)
+		}
+		config.Journal.Record("grant-role", payload, "RoleGrant", grantId)
+	}
+
 	return nil
 }
 
+// fetchAllMembers pages through GET /rbac/members and returns every user and service principal.
+func fetchAllMembers(config *Config) ([]MemberSummary, error) {
+	const pageSize = 200
+
+	var members []MemberSummary
+	for offset := 0; ; offset += pageSize {
+		url := fmt.Sprintf("%s/rbac/members?type=All&limit=%d&offset=%d", config.ApiUrl, pageSize, offset)
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("failed to fetch members: %v", err)
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("unexpected status %d", resp.StatusCode)
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		var page struct {
+			Items []MemberSummary `json:"items"`
+			Total int             `json:"total"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("failed to decode members response: %v", err)
+			return nil, err
+		}
+
+		members = append(members, page.Items...)
+		if len(page.Items) < pageSize || len(members) >= page.Total {
+			return members, nil
+		}
+	}
+}
+
 func fetchRoleGrantsForGroup(config *Config, groupID string) ([]RoleAssignment, error) {
 	url := fmt.Sprintf("%s/rbac/role/groups/%s", config.ApiUrl, groupID)
 	req, _ := http.NewRequest("GET", url, nil)
@@ -535,71 +723,80 @@ func fetchRoleGrantsForGroup(config *Config, groupID string) ([]RoleAssignment,
 	return roleAssignments, nil
 }
 
-func ensureGroupRoles(config *Config, groupSpec ManagedGroup, availableGroups map[string]Group, availableRoles map[string]string) {
-	group, exists := availableGroups[groupSpec.Name]
-	if !exists {
-		log.Fatalf("group '%s' is not available for role synchronization", groupSpec.Name)
-	}
+func fetchRoleGrantsForUser(config *Config, userID string) ([]RoleAssignment, error) {
+	url := fmt.Sprintf("%s/rbac/role/user/%s", config.ApiUrl, userID)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 
-	roleAssignments, err := fetchRoleGrantsForGroup(config, group.ID)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failed to fetch role grants for group '%s': %v", groupSpec.Name, err)
+		log.Printf("failed to fetch role grants for user: %v", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	existingRoleGrants := make(map[string]RoleAssignment)
-	for _, assignment := range roleAssignments {
-		key := fmt.Sprintf(
-			"%s|%s|%s",
-			assignment.RoleId,
-			strings.ToLower(strings.TrimSpace(assignment.Type)),
-			normalizeGrantResource(assignment.Type, assignment.Resource),
-		)
-		existingRoleGrants[key] = assignment
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("unexpected status %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
 	}
 
-	expectedRoleGrants := make(map[string]RoleBinding)
-	for _, binding := range groupSpec.Roles {
-		roleID, roleExists := availableRoles[strings.ToLower(binding.RoleName)]
-		if !roleExists {
-			log.Fatalf("role '%s' required for group '%s' does not exist", binding.RoleName, groupSpec.Name)
-		}
+	var roleAssignments []RoleAssignment
+	if err := json.NewDecoder(resp.Body).Decode(&roleAssignments); err != nil {
+		log.Printf("failed to decode role grants response: %v", err)
+		return nil, err
+	}
 
-		assignmentType := strings.TrimSpace(binding.Scope)
-		if assignmentType == "" {
-			assignmentType = "Global"
-		}
+	return roleAssignments, nil
+}
 
-		key := fmt.Sprintf(
-			"%s|%s|%s",
-			roleID,
-			strings.ToLower(assignmentType),
-			normalizeGrantResource(assignmentType, "*"),
-		)
-		expectedRoleGrants[key] = binding
+// revokeRole removes a role grant. The full grant is journaled so the revocation itself can be rolled back.
+func revokeRole(config *Config, grant RoleAssignment) error {
+	url := fmt.Sprintf("%s/rbac/role/revoke/%s", config.ApiUrl, grant.ID)
+	return sendDelete(config, url, "revoke-role", grant, "RoleGrant", grant.ID)
+}
 
-		if _, granted := existingRoleGrants[key]; !granted {
-			resource := normalizeGrantResource(assignmentType, "*")
-			if err := assignRole(config, roleID, "Group", group.ID, assignmentType, resource); err != nil {
-				log.Fatalf("failed to assign role '%s' to group '%s': %v", binding.RoleName, groupSpec.Name, err)
-			}
-			if config.Debug {
-				log.Printf("- Assigned role '%s' (%s) to group '%s'.", binding.RoleName, assignmentType, groupSpec.Name)
-			}
-		}
+// revokePermission removes a permission grant. The full grant is journaled so the revocation itself can be rolled back.
+func revokePermission(config *Config, grant PermissionGrant) error {
+	url := fmt.Sprintf("%s/rbac/permission/revoke/%s", config.ApiUrl, grant.ID)
+	return sendDelete(config, url, "revoke-permission", grant, "PermissionGrant", grant.ID)
+}
+
+func deleteRole(config *Config, roleId string) error {
+	url := fmt.Sprintf("%s/rbac/role/%s", config.ApiUrl, roleId)
+	return sendDelete(config, url, "delete-role", map[string]string{"id": roleId}, "Role", roleId)
+}
+
+func deleteGroup(config *Config, groupId string) error {
+	url := fmt.Sprintf("%s/rbac/groups/%s", config.ApiUrl, groupId)
+	return sendDelete(config, url, "delete-group", map[string]string{"id": groupId}, "Group", groupId)
+}
+
+func sendDelete(config *Config, url, action string, request interface{}, objectType, objectId string) error {
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	for key, assignment := range existingRoleGrants {
-		if _, expected := expectedRoleGrants[key]; !expected {
-			log.Printf("- WARNING: group '%s' has unexpected role assignment (roleId='%s', type='%s', resource='%s'). Please review manually.", groupSpec.Name, assignment.RoleId, assignment.Type, assignment.Resource)
-		}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to %s: %s, [error code %d]", action, string(b), resp.StatusCode)
 	}
+	config.Journal.Record(action, request, objectType, objectId)
+
+	return nil
 }
 
 func resolveManagedGroups(config *Config) []ManagedGroup {
 	if len(config.Groups) > 0 {
 		groups := make([]ManagedGroup, 0, len(config.Groups))
 		for _, g := range config.Groups {
-			groups = append(groups, ManagedGroup{Name: g.Name, Roles: g.Roles, Members: g.Members})
+			groups = append(groups, ManagedGroup{Name: g.Name, ExistingId: g.ExistingId, Roles: g.Roles, Members: g.Members})
 		}
 		return groups
 	}
@@ -634,56 +831,15 @@ func normalizeGrantResource(scope, resource string) string {
 	return strings.TrimSpace(resource)
 }
 
-func ensureGroupMembers(config *Config, groupSpec ManagedGroup, availableGroups map[string]Group) {
-	group, exists := availableGroups[groupSpec.Name]
-	if !exists {
-		log.Fatalf("group '%s' is not available for member synchronization", groupSpec.Name)
-	}
-
-	existingMembers := make(map[string]string)
-	for _, member := range group.Members {
-		normalized := strings.ToLower(strings.TrimSpace(member.UserId))
-		if normalized != "" {
-			existingMembers[normalized] = member.UserId
-		}
-	}
-
-	expectedMembers := make(map[string]string)
-	for _, member := range groupSpec.Members {
-		normalized := strings.ToLower(strings.TrimSpace(member))
-		if normalized != "" {
-			expectedMembers[normalized] = member
-		}
-	}
-
-	for normalized, member := range expectedMembers {
-		if _, exists := existingMembers[normalized]; !exists {
-			createMembership(config, group.ID, member)
-			if config.Debug {
-				log.Printf("- Added member '%s' to group '%s'.", member, groupSpec.Name)
-			}
-		}
-	}
-
-	for normalized, member := range existingMembers {
-		if _, expected := expectedMembers[normalized]; !expected {
-			removeMembership(config, group.ID, member)
-			if config.Debug {
-				log.Printf("- Removed member '%s' from group '%s'.", member, groupSpec.Name)
-			}
-		}
-	}
-}
-
-func fetchPermissionsForRole(config *Config, roleId string) (map[string][]string, error) {
-	url := fmt.Sprintf("%s/rbac/permission/role/%s", config.ApiUrl, roleId)
+func fetchPermissionGrants(config *Config, entityType, entityId string) ([]PermissionGrant, error) {
+	url := fmt.Sprintf("%s/rbac/permission/%s/%s", config.ApiUrl, strings.ToLower(entityType), entityId)
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("failed to fetch permissions for role: %v", err)
+		log.Printf("failed to fetch permissions for %s: %v", strings.ToLower(entityType), err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -699,16 +855,7 @@ func fetchPermissionsForRole(config *Config, roleId string) (map[string][]string
 		return nil, err
 	}
 
-	permissionMap := make(map[string][]string)
-	for _, p := range permissions {
-		// Baseline script manages global role permissions only.
-		if !strings.EqualFold(p.Type, "Global") {
-			continue
-		}
-		permissionMap[p.Namespace] = append(permissionMap[p.Namespace], p.Permission)
-	}
-
-	return permissionMap, nil
+	return permissions, nil
 }
 
 func shouldSkipRole(roleName string) bool {
@@ -743,16 +890,21 @@ func normalizePermissionMap(input map[string][]string) map[string][]string {
 }
 
 func grantPermission(config *Config, entityType, entityId, namespace, permission string) error {
-	url := fmt.Sprintf("%s/rbac/permission/grant", config.ApiUrl)
-
-	payload := PermissionGrantCreation{
+	return grantScopedPermission(config, PermissionGrantCreation{
 		Namespace:          namespace,
 		Permission:         permission,
 		AssignedEntityType: entityType,
 		AssignedEntityId:   entityId,
 		Type:               "Global",
 		Resource:           "*",
-	}
+	})
+}
+
+func grantScopedPermission(config *Config, payload PermissionGrantCreation) error {
+	url := fmt.Sprintf("%s/rbac/permission/grant", config.ApiUrl)
+	entityType, entityId := payload.AssignedEntityType, payload.AssignedEntityId
+	namespace, permission := payload.Namespace, payload.Permission
+
 	body, _ := json.Marshal(payload)
 	if config.Debug {
 		log.Printf(
@@ -786,34 +938,17 @@ func grantPermission(config *Config, entityType, entityId, namespace, permission
 		log.Printf("- Granted missing permission '%s' in namespace '%s' to %s (%s).", permission, namespace, entityType, entityId)
 	}
 
-	return nil
-}
-
-func differences(a, b []string) (onlyInA, onlyInB []string) {
-	setA := make(map[string]struct{}, len(a))
-	setB := make(map[string]struct{}, len(b))
-
-	for _, v := range a {
-		setA[v] = struct{}{}
-	}
-	for _, v := range b {
-		setB[v] = struct{}{}
-	}
-
-	// elements in A but not in B
-	for _, v := range a {
-		if _, found := setB[v]; !found {
-			onlyInA = append(onlyInA, v)
-		}
-	}
-	// elements in B but not in A
-	for _, v := range b {
-		if _, found := setA[v]; !found {
-			onlyInB = append(onlyInB, v)
+	// The grant endpoint does not return the created grant, so look it up for the journal, if there is one.
+	// If that fails, a rollback looks the grant up again from the journaled request.
+	if config.Journal != nil {
+		grantId, err := lookupPermissionGrantId(config, payload)
+		if err != nil {
+			log.Printf("- WARNING: could not resolve ID of new permission grant for %s '%s', a rollback will look it up: %v", entityType, entityId, err)
 		}
+		config.Journal.Record("grant-permission", payload, "PermissionGrant", grantId)
 	}
 
-	return
+	return nil
 }
 
 func extractEmails(members []Member) []string {
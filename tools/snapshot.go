@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+RBAC state and snapshots
+
+The same state structure describes the live environment, the state config.json asks for and the
+contents of a snapshot file, so all three can be fed to the diff engine in plan.go. A live state holds
+roles with their permissions and groups with their members and grants. The snapshot, restore and explain
+commands also read the role and permission grants every member of /rbac/members holds directly, which
+include their capability roles. Pre-apply snapshots of commands that never touch user grants leave them
+out, and restoring one leaves user grants as they are.
+*/
+
+const defaultSnapshotDir = "snapshots"
+
+type RbacState struct {
+	CapturedAt time.Time    `json:"capturedAt"`
+	ApiUrl     string       `json:"apiUrl"`
+	Roles      []StateRole  `json:"roles"`
+	Groups     []StateGroup `json:"groups"`
+	Users      []StateUser  `json:"users,omitempty"` // direct user grants
+
+	// Set when Users holds every user's grants; older and pre-apply snapshots lack them
+	UsersCaptured bool `json:"usersCaptured,omitempty"`
+
+	Source string `json:"-"` // where the state came from, used in warnings
+}
+
+type StateRole struct {
+	ID          string            `json:"id,omitempty"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Permissions []PermissionGrant `json:"permissions"`
+}
+
+type StateGroup struct {
+	ID          string            `json:"id,omitempty"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Members     []string          `json:"members"`
+	RoleGrants  []StateRoleGrant  `json:"roleGrants"`
+	Permissions []PermissionGrant `json:"permissions"`
+
+	// Members whose access in config.json has expired; removed even when members are not synchronized
+	ExpiredMembers []string `json:"expiredMembers,omitempty"`
+}
+
+// StateUser holds grants given to a user directly, such as capability roles. The sync leaves them alone;
+// restore reverts them.
+type StateUser struct {
+	ID          string            `json:"id"`
+	RoleGrants  []StateRoleGrant  `json:"roleGrants"`
+	Permissions []PermissionGrant `json:"permissions"`
+}
+
+// StateRoleGrant carries the role name next to the ID so a snapshot can be restored into an
+// environment where the same role has a different ID.
+type StateRoleGrant struct {
+	RoleAssignment
+	RoleName string      `json:"roleName"`
+	Expires  *ExpiryDate `json:"expires,omitempty"` // from config.json; expired grants are revoked
+}
+
+// fetchState reads the roles and groups of an environment. Direct user grants cost two calls per member,
+// so they are only read with withUsers, for the commands that look at them.
+func fetchState(config *Config, withUsers bool) (*RbacState, error) {
+	state := &RbacState{
+		CapturedAt: time.Now().UTC(),
+		ApiUrl:     config.ApiUrl,
+		Source:     config.ApiUrl,
+	}
+
+	roles, err := fetchRoleList(config)
+	if err != nil {
+		return nil, fmt.Errorf("roles: %w", err)
+	}
+
+	roleNames := make(map[string]string, len(roles))
+	for _, role := range roles {
+		permissions, err := fetchPermissionGrants(config, "Role", role.ID)
+		if err != nil {
+			return nil, fmt.Errorf("permissions for role '%s': %w", role.Name, err)
+		}
+		roleNames[strings.ToLower(role.ID)] = role.Name
+		state.Roles = append(state.Roles, StateRole{
+			ID:          role.ID,
+			Name:        role.Name,
+			Type:        role.Type,
+			Description: role.Description,
+			Permissions: permissions,
+		})
+	}
+
+	groups, err := fetchGroupList(config)
+	if err != nil {
+		return nil, fmt.Errorf("groups: %w", err)
+	}
+
+	for _, group := range groups {
+		if isLockGroup(group.Name) {
+			continue
+		}
+		roleGrants, err := fetchRoleGrantsForGroup(config, group.ID)
+		if err != nil {
+			return nil, fmt.Errorf("role grants for group '%s': %w", group.Name, err)
+		}
+		permissions, err := fetchPermissionGrants(config, "Group", group.ID)
+		if err != nil {
+			return nil, fmt.Errorf("permissions for group '%s': %w", group.Name, err)
+		}
+
+		stateGroup := StateGroup{
+			ID:          group.ID,
+			Name:        group.Name,
+			Description: group.Description,
+			Members:     extractEmails(group.Members),
+			Permissions: permissions,
+		}
+		for _, grant := range roleGrants {
+			roleName, known := roleNames[strings.ToLower(grant.RoleId)]
+			if !known {
+				roleName = grant.RoleId
+			}
+			stateGroup.RoleGrants = append(stateGroup.RoleGrants, StateRoleGrant{RoleAssignment: grant, RoleName: roleName})
+		}
+		state.Groups = append(state.Groups, stateGroup)
+	}
+	if !withUsers {
+		return state, nil
+	}
+
+	members, err := fetchAllMembers(config)
+	if err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+	if err := fetchUserGrants(config, state, members); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// fetchUserGrants adds the direct grants of the given members to a state fetched without them.
+func fetchUserGrants(config *Config, state *RbacState, members []MemberSummary) error {
+	roleNames := make(map[string]string, len(state.Roles))
+	for _, role := range state.Roles {
+		roleNames[strings.ToLower(role.ID)] = role.Name
+	}
+
+	for _, member := range members {
+		roleGrants, err := fetchRoleGrantsForUser(config, member.Id)
+		if err != nil {
+			return fmt.Errorf("role grants for user '%s': %w", member.Id, err)
+		}
+		permissions, err := fetchPermissionGrants(config, "User", member.Id)
+		if err != nil {
+			return fmt.Errorf("permissions for user '%s': %w", member.Id, err)
+		}
+		if len(roleGrants) == 0 && len(permissions) == 0 {
+			continue
+		}
+
+		stateUser := StateUser{ID: member.Id, Permissions: permissions}
+		for _, grant := range roleGrants {
+			roleName, known := roleNames[strings.ToLower(grant.RoleId)]
+			if !known {
+				roleName = grant.RoleId
+			}
+			stateUser.RoleGrants = append(stateUser.RoleGrants, StateRoleGrant{RoleAssignment: grant, RoleName: roleName})
+		}
+		state.Users = append(state.Users, stateUser)
+	}
+	state.UsersCaptured = true
+
+	return nil
+}
+
+// desiredStateFromConfig turns config.json into the state the baseline sync should converge on.
+func desiredStateFromConfig(config *Config) *RbacState {
+	state := &RbacState{ApiUrl: config.ApiUrl, Source: "config.json"}
+
+	for _, role := range config.Roles {
+		roleType := role.Type
+		if roleType == "" {
+			roleType = "Global"
+		}
+
+		stateRole := StateRole{ID: role.ExistingId, Name: role.Name, Type: roleType}
+		for namespace, permissions := range normalizePermissionMap(role.Permissions) {
+			for _, permission := range permissions {
+				stateRole.Permissions = append(stateRole.Permissions, PermissionGrant{
+					Namespace:  namespace,
+					Permission: permission,
+					Type:       "Global",
+					Resource:   "*",
+				})
+			}
+		}
+		state.Roles = append(state.Roles, stateRole)
+	}
+
+	for _, groupSpec := range resolveManagedGroups(config) {
+		members, expiredMembers := splitMembers(groupSpec.Members, time.Now().UTC())
+		stateGroup := StateGroup{ID: groupSpec.ExistingId, Name: groupSpec.Name, Members: members, ExpiredMembers: expiredMembers}
+		for _, binding := range groupSpec.Roles {
+			assignmentType := strings.TrimSpace(binding.Scope)
+			if assignmentType == "" {
+				assignmentType = "Global"
+			}
+			stateGroup.RoleGrants = append(stateGroup.RoleGrants, StateRoleGrant{
+				RoleAssignment: RoleAssignment{
+					AssignedEntityType: "Group",
+					Type:               assignmentType,
+					Resource:           normalizeGrantResource(assignmentType, "*"),
+				},
+				RoleName: binding.RoleName,
+				Expires:  binding.Expires,
+			})
+		}
+		state.Groups = append(state.Groups, stateGroup)
+	}
+
+	return state
+}
+
+func saveSnapshot(config *Config, state *RbacState) (string, error) {
+	dir := config.SnapshotDir
+	if dir == "" {
+		dir = defaultSnapshotDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// Milliseconds and the run ID keep a pre-apply snapshot and a manual one taken in the same second apart.
+	name := "rbac-snapshot-" + state.CapturedAt.Format("20060102T150405.000Z")
+	if config.RunId != "" {
+		name += "-" + config.RunId
+	}
+	path := filepath.Join(dir, name+".json")
+	body, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func loadSnapshot(path string) (*RbacState, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state RbacState
+	if err := json.Unmarshal(file, &state); err != nil {
+		return nil, err
+	}
+	state.Source = path
+
+	return &state, nil
+}
+
+/*
+Commands
+*/
+
+func runSnapshot(config *Config) {
+	state, err := fetchState(config, true)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+
+	path, err := saveSnapshot(config, state)
+	if err != nil {
+		fatalf("failed to write snapshot: %v", err)
+	}
+
+	log.Printf("Snapshot of %s written to '%s' (%d roles, %d groups, %d users with direct grants).", config.ApiUrl, path, len(state.Roles), len(state.Groups), len(state.Users))
+}
+
+// runRestore reconciles the environment back to a snapshot. Unlike the baseline sync it is exhaustive:
+// members are synchronized and user grants are reverted. Roles and groups not in the snapshot, and the
+// grants hanging off them, are only revoked or deleted when the tool owns them (see provenance.go), so
+// objects made outside the tool are reported, not reverted, unless --all is given. User grants are left
+// alone when restoring a snapshot taken before they were captured.
+func runRestore(config *Config, args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	all := flags.Bool("all", false, "also revoke and delete roles, groups and grants not made by this tool")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fatalf("usage: restore [--all] <snapshot>")
+	}
+	snapshotPath := flags.Arg(0)
+
+	desired, err := loadSnapshot(snapshotPath)
+	if err != nil {
+		fatalf("failed to load snapshot '%s': %v", snapshotPath, err)
+	}
+
+	log.Printf(">> Restoring RBAC state from '%s' (captured %s from %s)...", snapshotPath, desired.CapturedAt.Format(time.RFC3339), desired.ApiUrl)
+
+	live, err := fetchState(config, desired.UsersCaptured)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+
+	if !desired.UsersCaptured {
+		log.Printf("- WARNING: '%s' does not include user grants; they are left as they are.", snapshotPath)
+	}
+
+	plan := computePlan(desired, live, PlanOptions{
+		Prune:            true,
+		SyncMembers:      true,
+		GroupPermissions: true,
+		UserGrants:       desired.UsersCaptured,
+		AdoptedIds:       adoptedIds(config),
+		IgnoreProvenance: *all,
+	})
+	plan.LogWarnings()
+
+	if len(plan.Changes) == 0 {
+		log.Println("<< Environment already matches the snapshot.")
+		return
+	}
+
+	preRestorePath, err := saveSnapshot(config, live)
+	if err != nil {
+		fatalf("failed to write pre-apply snapshot: %v", err)
+	}
+	log.Printf("Pre-apply snapshot written to '%s'.", preRestorePath)
+
+	applyPlan(config, plan)
+
+	log.Printf("<< Restore completed: %d change(s) applied.", len(plan.Changes))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+Team links
+
+Teams in the portal can be linked to capabilities (POST /teams/{id}/capability-links/{capabilityId}),
+but a link gives no access by itself. `team-links` turns the links into capability role grants: each
+mapping in config.json gives a team's RBAC group a role on every capability the team is linked to.
+
+	"teamLinks": [
+	    { "team": "Cloud Engineering", "group": "CloudEngineeringReaders", "role": "Reader" }
+	]
+
+team is the team's name or ID. The mapped group's Capability-scoped grants of the mapped role belong to
+the mapping: a grant is made for every new link and revoked when the link is removed, and sync leaves
+them alone. Map teams to groups of their own: groups protected by safeguards fail lint. Run it after
+sync, e.g. on a schedule. Changes are journaled like a sync and can be rolled back; --dry-run only
+prints them.
+*/
+
+type TeamLinkMapping struct {
+	Team  string `json:"team"`
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+type Team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func fetchTeams(config *Config) ([]Team, error) {
+	url := fmt.Sprintf("%s/teams", config.ApiUrl)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var result struct {
+		Items []Team `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Items, nil
+}
+
+func fetchTeamCapabilityLinks(config *Config, teamId string) ([]Capability, error) {
+	url := fmt.Sprintf("%s/teams/%s/capability-links", config.ApiUrl, teamId)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for %s: %d", url, resp.StatusCode)
+	}
+
+	var result struct {
+		Items []Capability `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result.Items, nil
+}
+
+func findTeam(teams []Team, nameOrId string) *Team {
+	for i, team := range teams {
+		if strings.EqualFold(team.ID, strings.TrimSpace(nameOrId)) || strings.EqualFold(team.Name, strings.TrimSpace(nameOrId)) {
+			return &teams[i]
+		}
+	}
+	return nil
+}
+
+func teamLinkKey(groupName, roleName string) string {
+	return groupName + "|" + roleKey(roleName)
+}
+
+// isTeamLinkGrant reports whether a group's role grant is maintained by a team link mapping.
+func isTeamLinkGrant(config *Config, groupName string, grant StateRoleGrant) bool {
+	if !strings.EqualFold(grant.Type, "Capability") {
+		return false
+	}
+	for _, mapping := range config.TeamLinks {
+		if mapping.Group == groupName && roleKey(mapping.Role) == roleKey(grant.RoleName) {
+			return true
+		}
+	}
+	return false
+}
+
+// computeTeamLinkPlan diffs the grants the team links ask for with the mapped groups' live grants. links
+// holds the linked capabilities per team ID. When a mapping's team, group or role cannot be found, its
+// group and role are left untouched rather than losing every grant.
+func computeTeamLinkPlan(config *Config, teams []Team, links map[string][]Capability, live *RbacState) *Plan {
+	plan := &Plan{RoleIds: make(map[string]string), GroupIds: make(map[string]string)}
+	for _, role := range live.Roles {
+		plan.RoleIds[roleKey(role.Name)] = role.ID
+	}
+	liveGroups := make(map[string]StateGroup)
+	for _, group := range live.Groups {
+		if _, duplicate := liveGroups[group.Name]; !duplicate {
+			liveGroups[group.Name] = group
+			plan.GroupIds[group.Name] = group.ID
+		}
+	}
+
+	// The capabilities each mapped group and role should be granted on, from all teams mapped to them
+	type target struct {
+		Group        string
+		Role         string
+		Capabilities map[string]bool
+	}
+	desired := make(map[string]*target)
+	skipped := make(map[string]bool)
+	for _, mapping := range config.TeamLinks {
+		key := teamLinkKey(mapping.Group, mapping.Role)
+		team := findTeam(teams, mapping.Team)
+		_, groupExists := liveGroups[mapping.Group]
+		_, roleExists := plan.RoleIds[roleKey(mapping.Role)]
+		switch {
+		case team == nil:
+			plan.warn("team '%s' in teamLinks does not exist; leaving the '%s' grants of group '%s' alone", mapping.Team, mapping.Role, mapping.Group)
+			skipped[key] = true
+			continue
+		case !groupExists:
+			plan.warn("group '%s' in teamLinks does not exist; run sync first or fix the mapping", mapping.Group)
+			skipped[key] = true
+			continue
+		case !roleExists:
+			plan.warn("role '%s' in teamLinks does not exist; run sync first or fix the mapping", mapping.Role)
+			skipped[key] = true
+			continue
+		}
+
+		if desired[key] == nil {
+			desired[key] = &target{Group: mapping.Group, Role: mapping.Role, Capabilities: make(map[string]bool)}
+		}
+		for _, c := range links[team.ID] {
+			if !strings.EqualFold(c.Status, "Deleted") {
+				desired[key].Capabilities[c.ID] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if skipped[key] {
+			continue
+		}
+		t := desired[key]
+
+		granted := make(map[string]bool)
+		for _, grant := range liveGroups[t.Group].RoleGrants {
+			if !strings.EqualFold(grant.Type, "Capability") || roleKey(grant.RoleName) != roleKey(t.Role) {
+				continue
+			}
+			if t.Capabilities[grant.Resource] {
+				granted[grant.Resource] = true
+				continue
+			}
+			plan.add(Change{Action: "revoke-role", GroupName: t.Group, RoleName: grant.RoleName, Type: grant.Type, Resource: grant.Resource, ObjectId: grant.ID})
+		}
+
+		capabilityIds := make([]string, 0, len(t.Capabilities))
+		for id := range t.Capabilities {
+			capabilityIds = append(capabilityIds, id)
+		}
+		sort.Strings(capabilityIds)
+		for _, id := range capabilityIds {
+			if !granted[id] {
+				plan.add(Change{Action: "grant-role", GroupName: t.Group, RoleName: t.Role, Type: "Capability", Resource: id})
+			}
+		}
+	}
+
+	sort.SliceStable(plan.Changes, func(i, j int) bool {
+		return changeOrder[plan.Changes[i].Action] < changeOrder[plan.Changes[j].Action]
+	})
+
+	return plan
+}
+
+func runTeamLinks(config *Config, args []string) {
+	flags := flag.NewFlagSet("team-links", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the grants and revocations")
+	flags.Parse(args)
+
+	if len(config.TeamLinks) == 0 {
+		log.Println("No teamLinks in config.json, nothing to do.")
+		return
+	}
+
+	log.Printf(">> Reconciling team links for %s...", config.ApiUrl)
+
+	// The lock is taken before reading anything, so the plan is made from a state no other run changes.
+	if !*dryRun {
+		startRun(config)
+		defer finishRun(config)
+	}
+
+	teams, err := fetchTeams(config)
+	if err != nil {
+		fatalf("failed to fetch teams: %v", err)
+	}
+	links := make(map[string][]Capability)
+	for _, mapping := range config.TeamLinks {
+		team := findTeam(teams, mapping.Team)
+		if team == nil {
+			continue
+		}
+		if _, fetched := links[team.ID]; fetched {
+			continue
+		}
+		if links[team.ID], err = fetchTeamCapabilityLinks(config, team.ID); err != nil {
+			fatalf("failed to fetch capability links of team '%s': %v", team.Name, err)
+		}
+	}
+
+	live, err := fetchState(config, false)
+	if err != nil {
+		fatalf("failed to fetch RBAC state: %v", err)
+	}
+
+	plan := computeTeamLinkPlan(config, teams, links, live)
+	plan.LogWarnings()
+
+	if len(plan.Changes) == 0 {
+		log.Println("<< Team link grants are up to date.")
+		return
+	}
+	if *dryRun {
+		for _, change := range plan.Changes {
+			log.Printf("  would %s", change)
+		}
+		log.Printf("<< Dry run: %d change(s) not applied.", len(plan.Changes))
+		return
+	}
+
+	snapshotPath, err := saveSnapshot(config, live)
+	if err != nil {
+		fatalf("failed to write pre-apply snapshot: %v", err)
+	}
+	log.Printf("Pre-apply snapshot written to '%s'.", snapshotPath)
+
+	applyPlan(config, plan)
+
+	log.Printf("<< Team links reconciled: %d change(s) applied.", len(plan.Changes))
+}
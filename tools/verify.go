@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+Access assertions
+
+Stored grants only say what was written; POST /rbac/can-they says what the API will actually allow. An
+assertions file states the intended access, and verify asks can-they about each statement:
+
+	{
+	    "assertions": [
+	        { "memberOf": "CloudEngineers", "can": ["system-admin/manage-permission-matrix"] },
+	        { "guest": true, "capability": "my-capability-abcde", "cannot": ["topics/create"] },
+	        { "user": "someone@dfds.com", "capability": "my-capability-abcde", "can": ["topics/read-public"] }
+	    ]
+	}
+
+A memberOf assertion is checked for every current member of the group. A guest is a principal without
+any grants, so only the Guest defaults apply to it.
+*/
+
+const (
+	defaultAssertionsPath = "assertions.json"
+	guestPrincipal        = "rbac-verify-guest@invalid"
+)
+
+type AccessAssertion struct {
+	Name       string   `json:"name,omitempty"`
+	User       string   `json:"user,omitempty"`
+	MemberOf   string   `json:"memberOf,omitempty"`
+	Guest      bool     `json:"guest,omitempty"`
+	Capability string   `json:"capability,omitempty"` // makes the check capability scoped on this capability
+	ObjectId   string   `json:"objectId,omitempty"`   // object for Global checks, rarely needed
+	Can        []string `json:"can,omitempty"`
+	Cannot     []string `json:"cannot,omitempty"`
+}
+
+func (a AccessAssertion) String() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	var who string
+	switch {
+	case a.Guest:
+		who = "guest"
+	case a.MemberOf != "":
+		who = fmt.Sprintf("member of %s", a.MemberOf)
+	default:
+		who = a.User
+	}
+	if a.Capability != "" {
+		who += " on " + a.Capability
+	}
+	return who
+}
+
+type AssertionsFile struct {
+	Assertions []AccessAssertion `json:"assertions"`
+}
+
+type CanTheyPermission struct {
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	AccessType string `json:"accessType"`
+}
+
+type CanTheyRequest struct {
+	Permissions []CanTheyPermission `json:"permissions"`
+	ObjectId    string              `json:"objectid"`
+	UserId      string              `json:"userId"`
+}
+
+type CanTheyResponse struct {
+	PermissionMatrix map[string]struct {
+		Permitted bool `json:"permitted"`
+	} `json:"permissionMatrix"`
+}
+
+func loadAssertions(path string) ([]AccessAssertion, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var assertions AssertionsFile
+	if err := json.Unmarshal(file, &assertions); err != nil {
+		return nil, err
+	}
+
+	for i, assertion := range assertions.Assertions {
+		principals := 0
+		for _, set := range []bool{assertion.User != "", assertion.MemberOf != "", assertion.Guest} {
+			if set {
+				principals++
+			}
+		}
+		if principals != 1 {
+			return nil, fmt.Errorf("assertion %d (%s): exactly one of user, memberOf and guest must be set", i+1, assertion)
+		}
+		seen := map[string]bool{}
+		for _, permission := range append(append([]string{}, assertion.Can...), assertion.Cannot...) {
+			if _, _, ok := splitPermission(permission); !ok {
+				return nil, fmt.Errorf("assertion %d (%s): '%s' is not namespace/permission", i+1, assertion, permission)
+			}
+			if seen[permission] {
+				return nil, fmt.Errorf("assertion %d (%s): '%s' is listed more than once", i+1, assertion, permission)
+			}
+			seen[permission] = true
+		}
+	}
+
+	return assertions.Assertions, nil
+}
+
+func splitPermission(value string) (string, string, bool) {
+	namespace, permission, ok := strings.Cut(strings.TrimSpace(value), "/")
+	return namespace, permission, ok && namespace != "" && permission != ""
+}
+
+func canThey(config *Config, userId, namespace, permission, accessType, objectId string) (bool, error) {
+	url := fmt.Sprintf("%s/rbac/can-they", config.ApiUrl)
+	payload := CanTheyRequest{
+		Permissions: []CanTheyPermission{{Namespace: namespace, Name: permission, AccessType: accessType}},
+		ObjectId:    objectId,
+		UserId:      userId,
+	}
+	body, _ := json.Marshal(payload)
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var result CanTheyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+
+	entry, found := result.PermissionMatrix[fmt.Sprintf("%s-%s", namespace, permission)]
+	if !found {
+		return false, fmt.Errorf("can-they response has no entry for %s/%s", namespace, permission)
+	}
+	return entry.Permitted, nil
+}
+
+// assertionPrincipals resolves an assertion to the user IDs can-they is asked about.
+func assertionPrincipals(assertion AccessAssertion, groups []Group) ([]string, error) {
+	switch {
+	case assertion.Guest:
+		return []string{guestPrincipal}, nil
+	case assertion.User != "":
+		return []string{assertion.User}, nil
+	}
+
+	for _, group := range groups {
+		if group.Name == assertion.MemberOf {
+			members := extractEmails(group.Members)
+			if len(members) == 0 {
+				return nil, fmt.Errorf("group '%s' has no members to check", group.Name)
+			}
+			return members, nil
+		}
+	}
+	return nil, fmt.Errorf("group '%s' not found", assertion.MemberOf)
+}
+
+/*
+Command
+*/
+
+// runVerify checks every assertion and prints a pass/fail table. It returns false if any check failed
+// or could not be made.
+func runVerify(config *Config, path string) bool {
+	assertions, err := loadAssertions(path)
+	if err != nil {
+		fatalf("failed to load assertions '%s': %v", path, err)
+	}
+
+	groups, err := fetchGroupList(config)
+	if err != nil {
+		fatalf("failed to fetch groups: %v", err)
+	}
+
+	log.Printf(">> Verifying %d assertion(s) from '%s' against %s...", len(assertions), path, config.ApiUrl)
+
+	passed, failed := 0, 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tASSERTION\tPRINCIPAL\tPERMISSION\tOBJECT\tEXPECTED\tACTUAL")
+
+	report := func(result string, assertion AccessAssertion, principal, permission, objectId, expected, actual string) {
+		if result == "PASS" {
+			passed++
+		} else {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", result, assertion, principal, permission, objectId, expected, actual)
+	}
+
+	for _, assertion := range assertions {
+		accessType, objectId := "global", assertion.ObjectId
+		if assertion.Capability != "" {
+			accessType, objectId = "capability", assertion.Capability
+		}
+
+		principals, err := assertionPrincipals(assertion, groups)
+		if err != nil {
+			report("ERROR", assertion, "-", "-", objectId, "-", err.Error())
+			continue
+		}
+
+		checks := map[string]bool{}
+		for _, permission := range assertion.Can {
+			checks[permission] = true
+		}
+		for _, permission := range assertion.Cannot {
+			checks[permission] = false
+		}
+
+		for _, principal := range principals {
+			for _, permission := range append(append([]string{}, assertion.Can...), assertion.Cannot...) {
+				expected := checks[permission]
+				namespace, name, _ := splitPermission(permission)
+				permitted, err := canThey(config, principal, namespace, name, accessType, objectId)
+				switch {
+				case err != nil:
+					report("ERROR", assertion, principal, permission, objectId, canLabel(expected), err.Error())
+				case permitted == expected:
+					report("PASS", assertion, principal, permission, objectId, canLabel(expected), canLabel(permitted))
+				default:
+					report("FAIL", assertion, principal, permission, objectId, canLabel(expected), canLabel(permitted))
+				}
+			}
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		log.Printf("<< Verification failed: %d passed, %d failed.", passed, failed)
+		return false
+	}
+	log.Printf("<< Verification passed: %d check(s).", passed)
+	return true
+}
+
+func canLabel(permitted bool) string {
+	if permitted {
+		return "CAN"
+	}
+	return "CANNOT"
+}